@@ -0,0 +1,211 @@
+package main
+
+// This file contains the admission control for image processing.  Decoding an
+// image needs memory proportional to its pixel count, so rather than letting
+// every request decode in parallel, each one reserves an estimate of what it
+// will need from a shared budget and waits until there's room.
+
+import (
+	"image"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Rough number of bytes needed per pixel while processing any image: the
+// decoded source, the RGBA copy we work on, a rotated copy of that, and a
+// flattened copy (for JPEG) or the working buffers of the encoder.
+const bytesPerPixel = 16
+
+// Extra bytes per pixel for the optional steps that make another full-size
+// copy of the image while the others are still in use.
+const (
+	// An RGBA copy to redact in, and one cropped to the aspect ratio.
+	redactBytesPerPixel = 4
+	cropBytesPerPixel   = 4
+
+	// Fingerprint suppression warps, resizes and blurs the image, and the
+	// blur needs a copy of its own.
+	fingerprintBytesPerPixel = 16
+
+	// The copy that the watermark is drawn on.
+	watermarkBytesPerPixel = 4
+
+	// Targeted JPEG qualities keep trial encodings, and decode them again to
+	// measure SSIM; the "best" format keeps an encoding in each format.
+	targetBytesPerPixel = 8
+	bestBytesPerPixel   = 8
+
+	// Renditions are made from the full-size image, which may be cropped
+	// first.
+	renditionBytesPerPixel = 4
+)
+
+// Estimates how much memory processing an image with the given header will
+// take, with the given options (which may be nil, if the image is only being
+// decoded and re-encoded).
+func estimateImageMemory(cfg image.Config, opts *SanitizeOptions) int64 {
+	perPixel := int64(bytesPerPixel)
+	if opts != nil {
+		if len(opts.Redactions) > 0 || opts.Faces != nil {
+			perPixel += redactBytesPerPixel
+		}
+		if opts.AspectWidth > 0 && opts.AspectHeight > 0 {
+			perPixel += cropBytesPerPixel
+		}
+		if opts.AntiFingerprint {
+			perPixel += fingerprintBytesPerPixel
+		}
+		if opts.Watermark != nil {
+			perPixel += watermarkBytesPerPixel
+		}
+		if opts.JPEGMode == "max_size" || opts.JPEGMode == "min_ssim" {
+			perPixel += targetBytesPerPixel
+		}
+		if opts.Format == "best" {
+			perPixel += bestBytesPerPixel
+		}
+		if len(opts.Renditions) > 0 {
+			perPixel += renditionBytesPerPixel
+		}
+	}
+	// Headers can claim sizes that would overflow, which are too large for
+	// any budget anyway.
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	if pixels > math.MaxInt64/perPixel {
+		return math.MaxInt64
+	}
+	return pixels * perPixel
+}
+
+type budgetWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// memoryBudget hands out reservations against a fixed number of bytes.
+// Waiters are served in the order they arrived, so a large image can't be
+// starved by a stream of small ones.
+type memoryBudget struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	waiters []*budgetWaiter
+}
+
+// Creates a new budget of the given number of bytes.  A limit of 0 means that
+// processing is not limited, and a nil budget is returned.
+func newMemoryBudget(limit int64) *memoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &memoryBudget{limit: limit}
+}
+
+// Fits returns whether a request for n bytes could ever be granted.  Ones
+// larger than the whole budget never are: an image that needs that much is
+// more likely to be a decompression bomb than anything worth processing.
+func (b *memoryBudget) Fits(n int64) bool {
+	return b == nil || n <= b.limit
+}
+
+// Acquire reserves n bytes, waiting up to timeout for them to become
+// available.  It returns the amount actually reserved - which must be passed
+// to Release - and whether the reservation succeeded.  Requests that don't
+// fit in the whole budget fail straight away.
+func (b *memoryBudget) Acquire(n int64, timeout time.Duration) (int64, bool) {
+	if b == nil {
+		return 0, true
+	}
+	if !b.Fits(n) {
+		return 0, false
+	}
+
+	b.mu.Lock()
+	if len(b.waiters) == 0 && b.used+n <= b.limit {
+		b.used += n
+		b.mu.Unlock()
+		return n, true
+	}
+
+	w := &budgetWaiter{n: n, ready: make(chan struct{})}
+	b.waiters = append(b.waiters, w)
+	log.WithFields(logrus.Fields{
+		"needed":      n,
+		"in_use":      b.used,
+		"limit":       b.limit,
+		"queue_depth": len(b.waiters),
+	}).Info("waiting for processing budget")
+	b.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return n, true
+	case <-timer.C:
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// We may have been granted the reservation just as we timed out.
+	select {
+	case <-w.ready:
+		return n, true
+	default:
+	}
+
+	for i, other := range b.waiters {
+		if other == w {
+			b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+			break
+		}
+	}
+
+	// Removing ourselves may have unblocked someone behind us.
+	b.grant()
+	return 0, false
+}
+
+// Release returns n bytes to the budget, waking up any waiters that now fit.
+func (b *memoryBudget) Release(n int64) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+	b.grant()
+}
+
+// QueueDepth returns the number of requests waiting for the budget.
+func (b *memoryBudget) QueueDepth() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.waiters)
+}
+
+// grant hands out reservations to waiters, in order, while they fit.  Must be
+// called with b.mu held.
+func (b *memoryBudget) grant() {
+	for len(b.waiters) > 0 {
+		w := b.waiters[0]
+		if b.used+w.n > b.limit {
+			break
+		}
+
+		b.used += w.n
+		b.waiters = b.waiters[1:]
+		close(w.ready)
+	}
+}
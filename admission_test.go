@@ -0,0 +1,87 @@
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := newMemoryBudget(100)
+
+	n, ok := b.Acquire(60, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, int64(60), n)
+
+	// Doesn't fit, so this should time out.
+	_, ok = b.Acquire(60, 10*time.Millisecond)
+	assert.False(t, ok)
+	assert.Equal(t, 0, b.QueueDepth())
+
+	// Should be granted once the first reservation is released.
+	done := make(chan bool)
+	go func() {
+		_, ok := b.Acquire(60, time.Second)
+		done <- ok
+	}()
+
+	for b.QueueDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	b.Release(n)
+	assert.True(t, <-done)
+
+	// Requests larger than the whole budget are refused without waiting,
+	// even when nothing else is using it.
+	b.Release(60)
+	assert.True(t, b.Fits(100))
+	assert.False(t, b.Fits(101))
+	start := time.Now()
+	n, ok = b.Acquire(1000, time.Second)
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), n)
+	assert.True(t, time.Since(start) < time.Second/2)
+	assert.Equal(t, 0, b.QueueDepth())
+
+	n, ok = b.Acquire(100, time.Second)
+	assert.True(t, ok)
+	b.Release(n)
+}
+
+func TestNilMemoryBudget(t *testing.T) {
+	b := newMemoryBudget(0)
+
+	assert.True(t, b.Fits(1<<40))
+	_, ok := b.Acquire(1<<40, 0)
+	assert.True(t, ok)
+	b.Release(0)
+}
+
+func TestEstimateImageMemory(t *testing.T) {
+	cfg := image.Config{Width: 1000, Height: 500}
+	assert.Equal(t, int64(500000*bytesPerPixel), estimateImageMemory(cfg, nil))
+	assert.Equal(t, int64(500000*bytesPerPixel), estimateImageMemory(cfg, &SanitizeOptions{JPEGMode: "fixed"}))
+
+	// Each step that keeps another copy of the image adds to it.
+	opts := &SanitizeOptions{
+		Format:          "best",
+		JPEGMode:        "min_ssim",
+		Redactions:      []Redaction{{}},
+		AspectWidth:     1,
+		AspectHeight:    1,
+		AntiFingerprint: true,
+		Watermark:       &WatermarkOptions{},
+		Renditions:      []RenditionSpec{{}},
+	}
+	perPixel := bytesPerPixel + redactBytesPerPixel + cropBytesPerPixel +
+		fingerprintBytesPerPixel + watermarkBytesPerPixel + targetBytesPerPixel +
+		bestBytesPerPixel + renditionBytesPerPixel
+	assert.Equal(t, int64(500000*perPixel), estimateImageMemory(cfg, opts))
+
+	// Sizes too large to count saturate rather than overflowing.
+	huge := image.Config{Width: 1 << 31, Height: 1 << 31}
+	assert.Equal(t, int64(math.MaxInt64), estimateImageMemory(huge, opts))
+}
@@ -0,0 +1,119 @@
+package main
+
+// This file contains an encoder for BlurHash (https://blurha.sh), a short
+// string that clients can decode into a blurry placeholder for an image.  The
+// image is described by the first few terms of its 2D cosine transform: the
+// average color, and a handful of low-frequency components, each quantized and
+// written in base 83.
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Images are scaled down to at most this size before being encoded - the
+// components are so coarse that the detail wouldn't change them.
+const blurHashSize = 64
+
+// Returns the BlurHash of an image, with the given number of components (from
+// 1 to 9) along each axis.
+func encodeBlurHash(img image.Image, xComponents, yComponents int) string {
+	small := imaging.Fit(img, blurHashSize, blurHashSize, imaging.Box)
+	w, h := small.Bounds().Dx(), small.Bounds().Dy()
+
+	// Work in linear light, as the decoder does.
+	linear := make([][3]float64, w*h)
+	for i := range linear {
+		for ch := 0; ch < 3; ch++ {
+			linear[i][ch] = sRGBToLinear(small.Pix[4*i+ch])
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				cy := math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+				for x := 0; x < w; x++ {
+					basis := norm * cy * math.Cos(math.Pi*float64(i)*float64(x)/float64(w))
+					for ch := range f {
+						f[ch] += basis * linear[y*w+x][ch]
+					}
+				}
+			}
+			for ch := range f {
+				f[ch] /= float64(w * h)
+			}
+			factors = append(factors, f)
+		}
+	}
+
+	dc, ac := factors[0], factors[1:]
+	hash := encodeBase83((xComponents-1)+(yComponents-1)*9, 1)
+
+	// The AC components are scaled by the largest of them, which is sent
+	// first.
+	maxValue := 1.0
+	if len(ac) > 0 {
+		var actualMax float64
+		for _, f := range ac {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantizedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantizedMax+1) / 166
+		hash += encodeBase83(quantizedMax, 1)
+	} else {
+		hash += encodeBase83(0, 1)
+	}
+
+	hash += encodeBase83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		quantize := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		hash += encodeBase83(quantize(f[0])*19*19+quantize(f[1])*19+quantize(f[2]), 2)
+	}
+
+	return hash
+}
+
+func encodeBase83(value, length int) string {
+	out := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		out[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(out)
+}
+
+func sRGBToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
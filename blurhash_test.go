@@ -0,0 +1,32 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeBlurHash(t *testing.T) {
+	img, err := imaging.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "LG6bcSozH;ayDga{yEayoyV@ROo#", encodeBlurHash(img, 4, 3))
+	assert.Equal(t, "TG6bcSozH;Dga{yEoyV@ROf5ogo#", encodeBlurHash(img, 3, 4))
+
+	// A plain image is just its color, with no detail.
+	plain := image.NewRGBA(image.Rect(0, 0, 30, 20))
+	draw.Draw(plain, plain.Bounds(), image.NewUniform(color.RGBA{0xff, 0x80, 0, 0xff}), image.ZP, draw.Src)
+	assert.Equal(t, "00TNoS", encodeBlurHash(plain, 1, 1))
+}
+
+func TestEncodeBase83(t *testing.T) {
+	assert.Equal(t, "0", encodeBase83(0, 1))
+	assert.Equal(t, "~", encodeBase83(82, 1))
+	assert.Equal(t, "10", encodeBase83(83, 2))
+	assert.Equal(t, "0000", encodeBase83(0, 4))
+}
@@ -0,0 +1,48 @@
+package main
+
+// This file contains the code that decides who may delete an image.  Each
+// upload is given a random deletion token, which is returned to the uploader
+// but only stored as a hash, so that the index can't be used to delete
+// images.  Admins - anyone with the upload credentials - can delete any image
+// without one.
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+)
+
+// The length of a deletion token.  Tokens are made of letters and digits, so
+// this is about 190 bits.
+const deleteTokenLength = 32
+
+// Returns a new deletion token, and the hash of it to keep in the index.
+func newDeleteToken() (token, hash string) {
+	token = randString(deleteTokenLength)
+	return token, hashDeleteToken(token)
+}
+
+func hashDeleteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns whether a token is the deletion token for an upload.
+func (rec *uploadRecord) CheckDeleteToken(token string) bool {
+	if len(rec.DeleteTokenHash) == 0 || len(token) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashDeleteToken(token)), []byte(rec.DeleteTokenHash)) == 1
+}
+
+// Returns whether a request has the upload credentials.
+func isAdmin(r *http.Request, config *Config) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(config.Auth.Username)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(config.Auth.Password)) == 1
+	return userOK && passwordOK
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/goamz/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/zenazn/goji/web"
+)
+
+func TestDeleteToken(t *testing.T) {
+	token, hash := newDeleteToken()
+	assert.Len(t, token, deleteTokenLength)
+
+	rec := &uploadRecord{DeleteTokenHash: hash}
+	assert.True(t, rec.CheckDeleteToken(token))
+	assert.False(t, rec.CheckDeleteToken(token[1:]))
+	assert.False(t, rec.CheckDeleteToken(""))
+	assert.False(t, rec.CheckDeleteToken(hash))
+
+	// Uploads from before there were tokens can't be deleted with one.
+	assert.False(t, (&uploadRecord{}).CheckDeleteToken(""))
+}
+
+func TestIsAdmin(t *testing.T) {
+	config := &Config{}
+	config.Auth.Username = "admin"
+	config.Auth.Password = "secret"
+
+	r, _ := http.NewRequest("DELETE", "/images/abc", nil)
+	assert.False(t, isAdmin(r, config))
+	r.SetBasicAuth("admin", "secret")
+	assert.True(t, isAdmin(r, config))
+	r.SetBasicAuth("admin", "wrong")
+	assert.False(t, isAdmin(r, config))
+}
+
+func TestDeleteImage(t *testing.T) {
+	b, quit := testBucket(t)
+	defer quit()
+	archive := b.S3.Bucket("archive")
+	if err := archive.PutBucket(s3.Private); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "imagehost-delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	idx, err := openUploadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	config := &Config{PublicBucket: "public", ArchiveBucket: "archive"}
+	config.Auth.Username = "admin"
+	config.Auth.Password = "secret"
+
+	token, hash := newDeleteToken()
+	for _, rec := range []*uploadRecord{
+		{ID: "abc123", Key: "abc123.png", ArchiveKey: "first.png", DeleteTokenHash: hash},
+		{ID: "def456", Key: "def456.png", ArchiveKey: "second.png"},
+		{ID: "jkl012", Key: "jkl012.png", ArchiveKey: "second.png"},
+	} {
+		assert.NoError(t, idx.Add(rec))
+	}
+	for _, key := range []string{"abc123.png", "abc123-small.png", "abc1234.png", "def456.png", "ghi789.png"} {
+		putPNG(t, b, key, 10, 10, nil)
+	}
+	for _, key := range []string{"first.png", "second.png"} {
+		assert.NoError(t, archive.Put(key, []byte("original"), "image/png", s3.Private))
+	}
+	cache := newMemoryCache(100)
+	for _, key := range []string{"abc123/100x100", "abc123/50x50", "abc1234/100x100"} {
+		cache.Put(key, &cachedImage{ContentType: "image/png", Data: []byte("transformed")})
+	}
+
+	del := func(id, query string, admin bool) (int, map[string]interface{}) {
+		r, _ := http.NewRequest("DELETE", "/images/"+id+query, nil)
+		if admin {
+			r.SetBasicAuth("admin", "secret")
+		}
+		w := httptest.NewRecorder()
+		DeleteImage(web.C{
+			URLParams: map[string]string{"id": id},
+			Env: map[string]interface{}{
+				"client": b.S3,
+				"config": config,
+				"cache":  cache,
+				"index":  idx,
+			},
+		}, w, r)
+
+		var resp map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+	keys := func(b *s3.Bucket) string {
+		list, err := b.List("", "", "", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, key := range list.Contents {
+			names = append(names, key.Key)
+		}
+		return strings.Join(names, " ")
+	}
+
+	// Without the right token, or without being an admin, nothing happens.
+	code, _ := del("abc123", "", false)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = del("abc123", "?token=wrong", false)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = del("abc123", "?archive=true&token="+token, false)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = del("ghi789", "?token="+token, false)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, "abc123-small.png abc123.png abc1234.png def456.png ghi789.png", keys(b))
+
+	// The token deletes the image and its renditions, but not the original.
+	code, resp := del("abc123", "?token="+token, false)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{"abc123.png", "abc123-small.png"}, resp["deleted"])
+	assert.Equal(t, false, resp["archive_deleted"])
+	assert.Equal(t, "abc1234.png def456.png ghi789.png", keys(b))
+	assert.Equal(t, "first.png second.png", keys(archive))
+	assert.Nil(t, idx.Get("abc123"))
+
+	// So are its transforms, but not those of the image with a longer ID.
+	_, ok := cache.Get("abc123/100x100")
+	assert.False(t, ok)
+	_, ok = cache.Get("abc123/50x50")
+	assert.False(t, ok)
+	_, ok = cache.Get("abc1234/100x100")
+	assert.True(t, ok)
+
+	// Originals that other uploads were archived under too aren't deleted,
+	// and neither is anything else.
+	code, _ = del("def456", "?archive=true", true)
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, "abc1234.png def456.png ghi789.png", keys(b))
+	assert.Equal(t, "first.png second.png", keys(archive))
+	code, _ = del("jkl012", "", true)
+	assert.Equal(t, http.StatusOK, code)
+
+	// Admins can delete anything, including the original.
+	code, resp = del("def456", "?archive=true", true)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, resp["archive_deleted"])
+	assert.Equal(t, "first.png", keys(archive))
+	code, _ = del("ghi789", "", true)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "abc1234.png", keys(b))
+
+	code, _ = del("abc123", "", true)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = del("../abc1234", "", true)
+	assert.Equal(t, http.StatusNotFound, code)
+}
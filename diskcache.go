@@ -0,0 +1,339 @@
+package main
+
+// This file contains a derivativeCache that keeps images on disk, so that the
+// cache can be larger than memory and survives restarts.
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Temporary files are given this prefix while they are being written, so
+// that a half-written file is never mistaken for a cached image.
+const diskCacheTempPrefix = ".tmp-"
+
+// The names of cached images within their image's directory (see
+// diskCacheName).  Anything else in the cache directory isn't ours, and is
+// left alone.
+var diskCacheFileRe = regexp.MustCompile(`^[0-9a-f]{64}\.(jpeg|png|gif)$`)
+
+// diskCache is a derivativeCache that stores each image in its own file,
+// named after a hash of its key and with the format as its extension, in a
+// directory named after the ID of the image it was made from.  When the total
+// size goes over the limit, the least recently used files are deleted.
+type diskCache struct {
+	dir   string
+	limit int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+
+	// The IDs that have been purged since the cache was opened.
+	purged map[string]bool
+}
+
+type diskCacheEntry struct {
+	name string
+	size int64
+}
+
+// Opens a disk cache in the given directory, creating it if needed, and
+// loads the index of the images that are already in it.
+func newDiskCache(dir string, limit int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	c := &diskCache{
+		dir:    dir,
+		limit:  limit,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+		purged: make(map[string]bool),
+	}
+	if err := c.warm(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reads the cached images in the cache directory into the index.  Files are
+// used in order of modification time, which Get updates, so the least
+// recently used files are still evicted first after a restart.  Nothing that
+// the cache didn't write is touched, in case the directory is shared.
+func (c *diskCache) warm() error {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	var files []cachedFile
+	for _, info := range infos {
+		if !info.IsDir() {
+			if strings.HasPrefix(info.Name(), diskCacheTempPrefix) {
+				// Left over from a write that was interrupted.
+				os.Remove(filepath.Join(c.dir, info.Name()))
+			}
+			continue
+		}
+		if !imageIDRe.MatchString(info.Name()) {
+			continue
+		}
+
+		images, err := ioutil.ReadDir(filepath.Join(c.dir, info.Name()))
+		if err != nil {
+			return err
+		}
+		for _, image := range images {
+			if image.Mode().IsRegular() && diskCacheFileRe.MatchString(image.Name()) {
+				files = append(files, cachedFile{filepath.Join(info.Name(), image.Name()), image})
+			}
+		}
+	}
+	sort.Sort(byModTime(files))
+
+	for _, f := range files {
+		c.items[f.name] = c.lru.PushFront(&diskCacheEntry{f.name, f.Size()})
+		c.size += f.Size()
+	}
+
+	// Nothing else can see the cache yet, so there's no need to lock it.
+	c.evict()
+
+	log.WithFields(logrus.Fields{
+		"dir":   c.dir,
+		"files": len(c.items),
+		"size":  c.size,
+	}).Info("loaded disk cache")
+	return nil
+}
+
+// cachedFile is a file in the cache, with its name relative to the cache
+// directory.
+type cachedFile struct {
+	name string
+	os.FileInfo
+}
+
+type byModTime []cachedFile
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+
+// Returns the name of the file for a key and content type, relative to the
+// cache directory.
+func diskCacheName(key, contentType string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(cacheKeyID(key), hex.EncodeToString(hash[:])+"."+strings.TrimPrefix(contentType, "image/"))
+}
+
+func (c *diskCache) Get(key string) (*cachedImage, bool) {
+	prefix := diskCacheName(key, "")
+
+	// We don't know the format of the image, so look for any extension.
+	c.mu.Lock()
+	var name string
+	for _, ext := range []string{"jpeg", "png", "gif"} {
+		if e, ok := c.items[prefix+ext]; ok {
+			name = prefix + ext
+			c.lru.MoveToFront(e)
+			break
+		}
+	}
+	c.mu.Unlock()
+	if len(name) == 0 {
+		return nil, false
+	}
+
+	path := filepath.Join(c.dir, name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err":  err,
+			"path": path,
+		}).Warn("could not read cached image")
+		c.remove(name)
+		return nil, false
+	}
+
+	// Record the use, so the order survives a restart.
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	return &cachedImage{
+		ContentType: "image/" + strings.TrimPrefix(filepath.Ext(name), "."),
+		Data:        data,
+	}, true
+}
+
+func (c *diskCache) Put(key string, img *cachedImage) {
+	size := int64(len(img.Data))
+	id := cacheKeyID(key)
+	if size > c.limit || !imageIDRe.MatchString(id) {
+		return
+	}
+	name := diskCacheName(key, img.ContentType)
+
+	// Write to a temporary file and then rename it into place, so that other
+	// requests (and restarts) only ever see complete files.
+	f, err := ioutil.TempFile(c.dir, diskCacheTempPrefix)
+	if err == nil {
+		_, err = f.Write(img.Data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	// The image's directory is made and filled with the lock held, so that
+	// a purge can't remove it in between, or happen before the file is in
+	// the index.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil && c.purged[id] {
+		os.Remove(f.Name())
+		return
+	}
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(c.dir, id), 0700)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		if f != nil {
+			os.Remove(f.Name())
+		}
+		log.WithFields(logrus.Fields{
+			"err": err,
+			"dir": c.dir,
+		}).Warn("could not write cached image")
+		return
+	}
+
+	if e, ok := c.items[name]; ok {
+		c.size -= e.Value.(*diskCacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.items[name] = c.lru.PushFront(&diskCacheEntry{name, size})
+	c.size += size
+	c.evict()
+}
+
+// Removes a file that could not be read from the index.
+func (c *diskCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[name]; ok {
+		c.size -= e.Value.(*diskCacheEntry).size
+		c.lru.Remove(e)
+		delete(c.items, name)
+	}
+	c.removeFile(name)
+}
+
+func (c *diskCache) Purge(id string) {
+	if !imageIDRe.MatchString(id) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.purged[id] = true
+	for name, e := range c.items {
+		if filepath.Dir(name) == id {
+			c.size -= e.Value.(*diskCacheEntry).size
+			c.lru.Remove(e)
+			delete(c.items, name)
+		}
+	}
+
+	// Files that aren't in the index are removed too, but only ones the
+	// cache could have written.
+	dir := filepath.Join(c.dir, id)
+	infos, err := ioutil.ReadDir(dir)
+	for _, info := range infos {
+		if err == nil && diskCacheFileRe.MatchString(info.Name()) {
+			err = os.Remove(filepath.Join(dir, info.Name()))
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(logrus.Fields{
+			"err": err,
+			"dir": dir,
+		}).Warn("could not purge cached images")
+	}
+	os.Remove(dir)
+}
+
+// Deletes a file, and the image's directory if that leaves it empty.
+func (c *diskCache) removeFile(name string) error {
+	err := os.Remove(filepath.Join(c.dir, name))
+	os.Remove(filepath.Join(c.dir, filepath.Dir(name)))
+	return err
+}
+
+// Deletes the least recently used files until the cache fits in its limit.
+// Must be called with the lock held.
+func (c *diskCache) evict() {
+	for c.size > c.limit {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*diskCacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.items, entry.name)
+		c.size -= entry.size
+
+		err := c.removeFile(entry.name)
+		if err != nil && !os.IsNotExist(err) {
+			log.WithFields(logrus.Fields{
+				"err":  err,
+				"name": entry.name,
+			}).Warn("could not evict cached image")
+		}
+	}
+}
+
+// countingCache wraps a derivativeCache, counting and logging hits and
+// misses.
+type countingCache struct {
+	derivativeCache
+	hits, misses int64
+}
+
+func (c *countingCache) Get(key string) (*cachedImage, bool) {
+	img, ok := c.derivativeCache.Get(key)
+
+	var hits, misses int64
+	if ok {
+		hits = atomic.AddInt64(&c.hits, 1)
+		misses = atomic.LoadInt64(&c.misses)
+	} else {
+		hits = atomic.LoadInt64(&c.hits)
+		misses = atomic.AddInt64(&c.misses, 1)
+	}
+
+	log.WithFields(logrus.Fields{
+		"key":    key,
+		"hit":    ok,
+		"hits":   hits,
+		"misses": misses,
+	}).Info("cache lookup")
+	return img, ok
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagehost-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newDiskCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := func(ct string, b byte) *cachedImage {
+		return &cachedImage{ContentType: ct, Data: []byte{b, b, b, b}}
+	}
+
+	c.Put("a/100x100", img("image/png", 'a'))
+	c.Put("b/100x100", img("image/jpeg", 'b'))
+
+	got, ok := c.Get("a/100x100")
+	if assert.True(t, ok) {
+		assert.Equal(t, img("image/png", 'a'), got)
+	}
+	got, ok = c.Get("b/100x100")
+	if assert.True(t, ok) {
+		assert.Equal(t, img("image/jpeg", 'b'), got)
+	}
+	_, ok = c.Get("c/100x100")
+	assert.False(t, ok)
+
+	// "a" was used least recently, so it's the one to go.
+	c.Put("c/100x100", img("image/gif", 'c'))
+	_, ok = c.Get("a/100x100")
+	assert.False(t, ok)
+	_, err = os.Stat(filepath.Join(dir, diskCacheName("a/100x100", "image/png")))
+	assert.True(t, os.IsNotExist(err))
+
+	// Reopening the cache picks up what's already there, and throws away any
+	// half-written files.
+	ioutil.WriteFile(filepath.Join(dir, diskCacheTempPrefix+"123"), []byte("partial"), 0600)
+	c, err = newDiskCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(8), c.size)
+
+	got, ok = c.Get("c/100x100")
+	if assert.True(t, ok) {
+		assert.Equal(t, img("image/gif", 'c'), got)
+	}
+	_, ok = c.Get("b/100x100")
+	assert.True(t, ok)
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 2)
+	for _, f := range files {
+		assert.True(t, f.IsDir(), f.Name())
+	}
+
+	// A smaller limit evicts on startup.
+	c, err = newDiskCache(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(4), c.size)
+}
+
+func TestDiskCacheShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagehost-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files that the cache didn't write, even ones that look a bit like
+	// cached images, are neither deleted nor counted.
+	others := []string{
+		"uploads.db",
+		"0123abcd.png",
+		filepath.Join("notes", "todo.txt"),
+		filepath.Join("abc", "readme.txt"),
+		filepath.Join("abc", "0123abcd.png"),
+		filepath.Join("not-an-id", diskCacheName("x/100x100", "image/png")[2:]),
+	}
+	for _, name := range others {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0700)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("keep this"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.MkdirAll(filepath.Join(dir, "abc"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, diskCacheName("abc/100x100", "image/png")), []byte("cached"), 0600)
+
+	c, err := newDiskCache(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(0), c.size)
+	_, ok := c.Get("abc/100x100")
+	assert.False(t, ok)
+
+	c.Purge("abc")
+	c.Put("notes/100x100", &cachedImage{ContentType: "image/png", Data: []byte("a")})
+	c.Put("notes/50x50", &cachedImage{ContentType: "image/png", Data: []byte("b")})
+	for _, name := range others {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, "keep this", string(data))
+		}
+	}
+}
+
+func TestDiskCachePurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagehost-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newDiskCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := &cachedImage{ContentType: "image/png", Data: []byte("data")}
+	for _, key := range []string{"a/100x100", "a/50x50", "ab/100x100"} {
+		c.Put(key, img)
+	}
+
+	c.Purge("a")
+	_, ok := c.Get("a/100x100")
+	assert.False(t, ok)
+	_, ok = c.Get("a/50x50")
+	assert.False(t, ok)
+	_, ok = c.Get("ab/100x100")
+	assert.True(t, ok)
+	assert.Equal(t, int64(4), c.size)
+	_, err = os.Stat(filepath.Join(dir, "a"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Transforms that were being made when the image was deleted aren't
+	// cached, and nothing is left behind by trying.
+	c.Put("a/100x100", img)
+	_, ok = c.Get("a/100x100")
+	assert.False(t, ok)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+
+	// Even while they're being written.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Put(fmt.Sprintf("b/%dx%d", i, i), img)
+		}(i)
+	}
+	c.Purge("b")
+	wg.Wait()
+	for i := 0; i < 4; i++ {
+		_, ok = c.Get(fmt.Sprintf("b/%dx%d", i, i))
+		assert.False(t, ok)
+	}
+	_, err = os.Stat(filepath.Join(dir, "b"))
+	assert.True(t, os.IsNotExist(err))
+
+	// IDs that aren't image IDs can't purge anything else.
+	c.Purge("..")
+	c.Purge("")
+	_, ok = c.Get("ab/100x100")
+	assert.True(t, ok)
+
+	// What's left is still there after a restart.
+	c, err = newDiskCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok = c.Get("ab/100x100")
+	assert.True(t, ok)
+	assert.Equal(t, int64(4), c.size)
+}
+
+func TestCountingCache(t *testing.T) {
+	c := &countingCache{derivativeCache: newMemoryCache(100)}
+
+	c.Put("a", &cachedImage{ContentType: "image/png", Data: []byte("a")})
+	c.Get("a")
+	c.Get("a")
+	c.Get("b")
+
+	assert.Equal(t, int64(2), c.hits)
+	assert.Equal(t, int64(1), c.misses)
+}
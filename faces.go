@@ -0,0 +1,331 @@
+package main
+
+// This file contains a face detector, used to redact faces in uploads.  It
+// runs cascades in the format used by pico (Markus et al., "Object Detection
+// with Pixel Intensity Comparisons Organized in Decision Trees", 2013) - for
+// example, pico's "facefinder" cascade.  The cascade isn't part of imagehost,
+// and has to be given in the config.
+//
+// A cascade file is made up of, in little-endian order:
+//
+//	float32 x 2     - the row and column scale of boxes (unused here)
+//	int32           - the depth of each tree
+//	int32           - the number of trees
+//
+// followed by each tree, which is:
+//
+//	int8 x 4 x (2^depth - 1) - the internal nodes, each of which compares
+//	                           the pixels at two (row, column) offsets from
+//	                           the center of the box, in 1/256ths of its size
+//	float32 x 2^depth        - the outputs of the leaves
+//	float32                  - the threshold the sum so far must exceed for
+//	                           the box to pass this stage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/disintegration/imaging"
+)
+
+// Images are scaled down to at most this size before looking for faces.
+const faceDetectionSize = 1024
+
+// How much detected boxes are grown by, on each side, before they are
+// redacted, so that the edges of faces and hair are covered too.
+const faceMargin = 0.15
+
+// FaceOptions controls how faces are found.
+type FaceOptions struct {
+	// The path to the cascade file.
+	Cascade string `json:"cascade"`
+
+	// The smallest and largest faces to look for, in pixels of the image
+	// that is searched (see faceDetectionSize).
+	MinSize int `json:"min_size"`
+	MaxSize int `json:"max_size"`
+
+	// How far the search window moves, relative to its size, and how much
+	// it grows between passes.
+	ShiftFactor float64 `json:"shift_factor"`
+	ScaleFactor float64 `json:"scale_factor"`
+
+	// The score a cluster of detections needs to count as a face.
+	Threshold float64 `json:"threshold"`
+}
+
+// FaceBox is a face found in an image.
+type FaceBox struct {
+	X      int     `json:"x"`
+	Y      int     `json:"y"`
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Score  float64 `json:"score"`
+}
+
+// cascade is a parsed pico cascade.
+type cascade struct {
+	depth      int
+	codes      []int8
+	preds      []float32
+	thresholds []float32
+}
+
+var (
+	cascadesMu sync.Mutex
+	cascades   = make(map[string]*cascade)
+)
+
+// Loads the cascade at a path, keeping it in memory for next time.
+func loadCascade(path string) (*cascade, error) {
+	cascadesMu.Lock()
+	defer cascadesMu.Unlock()
+
+	if c, ok := cascades[path]; ok {
+		return c, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseCascade(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	cascades[path] = c
+	return c, nil
+}
+
+var errShortCascade = errors.New("cascade is truncated")
+
+func parseCascade(data []byte) (*cascade, error) {
+	if len(data) < 16 {
+		return nil, errShortCascade
+	}
+
+	depth := int(int32(binary.LittleEndian.Uint32(data[8:])))
+	ntrees := int(int32(binary.LittleEndian.Uint32(data[12:])))
+	if depth < 1 || depth > 16 || ntrees < 1 {
+		return nil, fmt.Errorf("cascade has invalid depth %d or tree count %d", depth, ntrees)
+	}
+
+	leaves := 1 << uint(depth)
+	treeSize := 4*(leaves-1) + 4*leaves + 4
+	if len(data)-16 < ntrees*treeSize {
+		return nil, errShortCascade
+	}
+
+	c := &cascade{depth: depth}
+	pos := 16
+	for t := 0; t < ntrees; t++ {
+		// Nodes are numbered from 1, so pad each tree with an unused one.
+		c.codes = append(c.codes, 0, 0, 0, 0)
+		for _, b := range data[pos : pos+4*(leaves-1)] {
+			c.codes = append(c.codes, int8(b))
+		}
+		pos += 4 * (leaves - 1)
+
+		for i := 0; i < leaves; i++ {
+			c.preds = append(c.preds, math.Float32frombits(binary.LittleEndian.Uint32(data[pos:])))
+			pos += 4
+		}
+
+		c.thresholds = append(c.thresholds, math.Float32frombits(binary.LittleEndian.Uint32(data[pos:])))
+		pos += 4
+	}
+
+	return c, nil
+}
+
+// Runs the cascade on the square box of size s centered on (r, c) in a
+// grayscale image with the given stride.  Returns the box's score, which is
+// positive if it passed every stage.
+func (cs *cascade) classify(r, c, s int, pixels []uint8, stride int) float32 {
+	leaves := 1 << uint(cs.depth)
+	r, c = r*256, c*256
+
+	var out float32
+	for t := range cs.thresholds {
+		codes := cs.codes[t*4*leaves:]
+		idx := 1
+		for j := 0; j < cs.depth; j++ {
+			p1 := ((r+int(codes[4*idx])*s)>>8)*stride + (c+int(codes[4*idx+1])*s)>>8
+			p2 := ((r+int(codes[4*idx+2])*s)>>8)*stride + (c+int(codes[4*idx+3])*s)>>8
+			idx *= 2
+			if pixels[p1] <= pixels[p2] {
+				idx++
+			}
+		}
+
+		out += cs.preds[t*leaves+idx-leaves]
+		if out <= cs.thresholds[t] {
+			return -1
+		}
+	}
+
+	return out - cs.thresholds[len(cs.thresholds)-1]
+}
+
+// Finds the faces in an image.  The boxes are in the image's coordinates.
+func detectFaces(img image.Image, opts *FaceOptions) ([]FaceBox, error) {
+	cs, err := loadCascade(opts.Cascade)
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	small := imaging.Grayscale(imaging.Fit(img, faceDetectionSize, faceDetectionSize, imaging.Box))
+	w, h := small.Bounds().Dx(), small.Bounds().Dy()
+	scale := float64(b.Dx()) / float64(w)
+
+	pixels := make([]uint8, w*h)
+	for i := range pixels {
+		pixels[i] = small.Pix[4*i]
+	}
+
+	var found []FaceBox
+	for s := float64(opts.MinSize); int(s) <= opts.MaxSize; s *= opts.ScaleFactor {
+		size := int(s)
+		step := int(math.Max(opts.ShiftFactor*s, 1))
+
+		// The nodes can look up to half the box away from its center.
+		half := size/2 + 1
+		for r := half; r < h-half; r += step {
+			for c := half; c < w-half; c += step {
+				if q := cs.classify(r, c, size, pixels, w); q > 0 {
+					found = append(found, FaceBox{c - size/2, r - size/2, size, size, float64(q)})
+				}
+			}
+		}
+	}
+
+	faces := clusterFaces(found, opts.Threshold)
+	for i := range faces {
+		f := &faces[i]
+		f.X = b.Min.X + int(float64(f.X)*scale)
+		f.Y = b.Min.Y + int(float64(f.Y)*scale)
+		f.Width = int(float64(f.Width) * scale)
+		f.Height = int(float64(f.Height) * scale)
+	}
+
+	log.WithFields(logrus.Fields{
+		"detections": len(found),
+		"faces":      len(faces),
+	}).Debug("looked for faces")
+	return faces, nil
+}
+
+// Merges overlapping detections of the same face, averaging their boxes and
+// adding up their scores, and returns those that score above the threshold.
+func clusterFaces(dets []FaceBox, threshold float64) []FaceBox {
+	sort.Sort(facesByScore(dets))
+
+	var faces []FaceBox
+	used := make([]bool, len(dets))
+	for i := range dets {
+		if used[i] {
+			continue
+		}
+
+		var x, y, size, score float64
+		n := 0
+		for j := i; j < len(dets); j++ {
+			if used[j] || faceOverlap(dets[i], dets[j]) <= 0.3 {
+				continue
+			}
+			used[j] = true
+			x += float64(dets[j].X)
+			y += float64(dets[j].Y)
+			size += float64(dets[j].Width)
+			score += dets[j].Score
+			n++
+		}
+
+		if score > threshold {
+			fn := float64(n)
+			faces = append(faces, FaceBox{
+				int(x/fn + 0.5), int(y/fn + 0.5),
+				int(size/fn + 0.5), int(size/fn + 0.5),
+				score,
+			})
+		}
+	}
+	return faces
+}
+
+type facesByScore []FaceBox
+
+func (s facesByScore) Len() int           { return len(s) }
+func (s facesByScore) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s facesByScore) Less(i, j int) bool { return s[i].Score > s[j].Score }
+
+// Returns the intersection over union of two boxes.
+func faceOverlap(a, b FaceBox) float64 {
+	ra := image.Rect(a.X, a.Y, a.X+a.Width, a.Y+a.Height)
+	rb := image.Rect(b.X, b.Y, b.X+b.Width, b.Y+b.Height)
+	in := ra.Intersect(rb)
+	if in.Empty() {
+		return 0
+	}
+
+	inArea := float64(in.Dx() * in.Dy())
+	return inArea / (float64(ra.Dx()*ra.Dy()+rb.Dx()*rb.Dy()) - inArea)
+}
+
+// Returns the redaction that covers a face, with some margin around it.
+func faceRedaction(f FaceBox) Redaction {
+	mx := int(float64(f.Width) * faceMargin)
+	my := int(float64(f.Height) * faceMargin)
+
+	x, y := f.X-mx, f.Y-my
+	w, h := f.Width+2*mx, f.Height+2*my
+	if x < 0 {
+		w, x = w+x, 0
+	}
+	if y < 0 {
+		h, y = h+y, 0
+	}
+	return Redaction{x, y, w, h, "pixelate"}
+}
+
+// Maps face boxes from the part r of an image onto an image of the given size
+// that was made from it by cropping to r and scaling, dropping any that were
+// cropped away entirely.
+func mapFaces(faces []FaceBox, r image.Rectangle, size image.Point) []FaceBox {
+	if len(faces) == 0 || r.Empty() {
+		return faces
+	}
+
+	sx := float64(size.X) / float64(r.Dx())
+	sy := float64(size.Y) / float64(r.Dy())
+	scale := func(v int, s float64) int {
+		return int(float64(v)*s + 0.5)
+	}
+
+	var mapped []FaceBox
+	for _, f := range faces {
+		b := image.Rect(f.X, f.Y, f.X+f.Width, f.Y+f.Height).Intersect(r).Sub(r.Min)
+		if b.Empty() {
+			continue
+		}
+		x, y := scale(b.Min.X, sx), scale(b.Min.Y, sy)
+		w, h := scale(b.Max.X, sx)-x, scale(b.Max.Y, sy)-y
+		if w < 1 {
+			w = 1
+		}
+		if h < 1 {
+			h = 1
+		}
+		mapped = append(mapped, FaceBox{x, y, w, h, f.Score})
+	}
+	return mapped
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Builds a cascade (with trees of depth 1) that finds bright squares on a
+// dark background, about half the size of the box: the first trees check
+// that points a little way from the center of the box are as bright as it,
+// and the rest that points further out are darker.
+func squareCascade() []byte {
+	var buf bytes.Buffer
+	write := func(v interface{}) { binary.Write(&buf, binary.LittleEndian, v) }
+
+	write([2]float32{1, 1})
+	write(int32(1))
+	write(int32(8))
+
+	// center <= point goes to the second leaf.
+	trees := []struct {
+		off    [2]int8
+		leaves [2]float32
+	}{
+		{[2]int8{-60, 0}, [2]float32{-1, 1}},
+		{[2]int8{60, 0}, [2]float32{-1, 1}},
+		{[2]int8{0, -60}, [2]float32{-1, 1}},
+		{[2]int8{0, 60}, [2]float32{-1, 1}},
+		{[2]int8{-70, 0}, [2]float32{1, -1}},
+		{[2]int8{70, 0}, [2]float32{1, -1}},
+		{[2]int8{0, -70}, [2]float32{1, -1}},
+		{[2]int8{0, 70}, [2]float32{1, -1}},
+	}
+	for i, tree := range trees {
+		write([4]int8{0, 0, tree.off[0], tree.off[1]})
+		write(tree.leaves)
+		write(float32(i) + 0.5)
+	}
+	return buf.Bytes()
+}
+
+func writeCascade(t *testing.T, data []byte) string {
+	f, err := ioutil.TempFile("", "imagehost-cascade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write(data)
+	return f.Name()
+}
+
+func TestParseCascade(t *testing.T) {
+	c, err := parseCascade(squareCascade())
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, c.depth)
+		assert.Len(t, c.thresholds, 8)
+		assert.Len(t, c.preds, 16)
+		assert.Len(t, c.codes, 8*4*2)
+		assert.Equal(t, int8(-60), c.codes[6])
+	}
+
+	data := squareCascade()
+	_, err = parseCascade(data[:len(data)-1])
+	assert.Error(t, err)
+	_, err = parseCascade(data[:10])
+	assert.Error(t, err)
+}
+
+func faceTestImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	draw.Draw(img, img.Bounds(), image.Black, image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(100, 80, 160, 140), image.White, image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(280, 150, 320, 190), image.White, image.ZP, draw.Src)
+	return img
+}
+
+func TestDetectFaces(t *testing.T) {
+	path := writeCascade(t, squareCascade())
+	defer os.Remove(path)
+
+	opts := &FaceOptions{
+		Cascade:     path,
+		MinSize:     20,
+		MaxSize:     200,
+		ShiftFactor: 0.02,
+		ScaleFactor: 1.05,
+		Threshold:   1,
+	}
+	faces, err := detectFaces(faceTestImage(), opts)
+	if !assert.NoError(t, err) || !assert.Len(t, faces, 2) {
+		return
+	}
+
+	// Each square should be found, in order of how sure we are.
+	for _, want := range []image.Rectangle{image.Rect(100, 80, 160, 140), image.Rect(280, 150, 320, 190)} {
+		found := false
+		for _, f := range faces {
+			box := image.Rect(f.X, f.Y, f.X+f.Width, f.Y+f.Height)
+			if box.Overlaps(want) && math.Abs(float64(box.Dx()-want.Dx())) < float64(want.Dx()) {
+				found = true
+			}
+		}
+		assert.True(t, found, "no face found at %v in %v", want, faces)
+	}
+	assert.True(t, faces[0].Score >= faces[1].Score)
+
+	// Nothing is found in a blank image.
+	blank := image.NewGray(image.Rect(0, 0, 200, 200))
+	faces, err = detectFaces(blank, opts)
+	assert.NoError(t, err)
+	assert.Len(t, faces, 0)
+}
+
+func TestSanitizeRedactsFaces(t *testing.T) {
+	path := writeCascade(t, squareCascade())
+	defer os.Remove(path)
+
+	var in bytes.Buffer
+	png.Encode(&in, faceTestImage())
+
+	opts := &SanitizeOptions{Faces: &FaceOptions{
+		Cascade:     path,
+		MinSize:     20,
+		MaxSize:     200,
+		ShiftFactor: 0.02,
+		ScaleFactor: 1.05,
+		Threshold:   1,
+	}}
+	out, res, err := SanitizeImageFrom(bytes.NewReader(in.Bytes()), opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, res.Faces, 2)
+
+	// The middle of each square has been pixelated together with the
+	// black around it, so it's no longer white.
+	img, err := png.Decode(out)
+	if assert.NoError(t, err) {
+		white := color.NRGBAModel.Convert(color.White)
+		assert.NotEqual(t, white, color.NRGBAModel.Convert(img.At(102, 82)))
+		assert.NotEqual(t, white, color.NRGBAModel.Convert(img.At(282, 152)))
+	}
+}
+
+func TestMapFaces(t *testing.T) {
+	faces := []FaceBox{
+		{100, 80, 60, 60, 2},
+		{280, 150, 40, 40, 1},
+		{0, 0, 20, 20, 1},
+	}
+
+	// Cropped to the right 300x300 of a 400x300 image and halved, the
+	// first face is cut in half and the last is gone.
+	assert.Equal(t, []FaceBox{
+		{0, 40, 30, 30, 2},
+		{90, 75, 20, 20, 1},
+	}, mapFaces(faces, image.Rect(100, 0, 400, 300), image.Pt(150, 150)))
+
+	assert.Nil(t, mapFaces(nil, image.Rect(0, 0, 10, 10), image.Pt(5, 5)))
+}
+
+func TestSanitizeMapsFaces(t *testing.T) {
+	path := writeCascade(t, squareCascade())
+	defer os.Remove(path)
+
+	var in bytes.Buffer
+	png.Encode(&in, faceTestImage())
+
+	// Cropped to a square in the middle, and scaled down to 150x150.
+	opts := &SanitizeOptions{
+		AspectWidth:  1,
+		AspectHeight: 1,
+		MaxWidth:     150,
+		Faces: &FaceOptions{
+			Cascade:     path,
+			MinSize:     20,
+			MaxSize:     200,
+			ShiftFactor: 0.02,
+			ScaleFactor: 1.05,
+			Threshold:   1,
+		},
+	}
+	_, res, err := SanitizeImageFrom(bytes.NewReader(in.Bytes()), opts)
+	if !assert.NoError(t, err) || !assert.Len(t, res.Faces, 2) {
+		return
+	}
+	assert.Equal(t, 150, res.Width)
+
+	// The faces are found around the squares at (100,80) and (280,150),
+	// which end up at (25,40) and (115,75).
+	if res.Faces[0].X > res.Faces[1].X {
+		res.Faces[0], res.Faces[1] = res.Faces[1], res.Faces[0]
+	}
+	for i, want := range []image.Point{{25 + 15, 40 + 15}, {115 + 10, 75 + 10}} {
+		f := res.Faces[i]
+		center := image.Pt(f.X+f.Width/2, f.Y+f.Height/2)
+		assert.InDelta(t, want.X, center.X, 5, "%+v", f)
+		assert.InDelta(t, want.Y, center.Y, 5, "%+v", f)
+	}
+}
+
+func TestFaceRedaction(t *testing.T) {
+	assert.Equal(t, Redaction{85, 85, 130, 130, "pixelate"}, faceRedaction(FaceBox{100, 100, 100, 100, 1}))
+	assert.Equal(t, Redaction{0, 0, 25, 25, "pixelate"}, faceRedaction(FaceBox{2, 2, 20, 20, 1}))
+}
+
+func TestSandboxRedactsFacesRelativeCascade(t *testing.T) {
+	// A cascade given relative to the working directory, which isn't the
+	// sandbox's.
+	name := "test-cascade.bin"
+	if err := ioutil.WriteFile(name, squareCascade(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+
+	config := sandboxTestConfig()
+	config.PublicBucket = "public"
+	config.AWSAuth.AccessKey = "access"
+	config.AWSAuth.SecretKey = "secret"
+	config.Faces.Cascade = name
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, filepath.IsAbs(config.Faces.Cascade))
+
+	var in bytes.Buffer
+	png.Encode(&in, faceTestImage())
+
+	var out bytes.Buffer
+	opts := &SanitizeOptions{Format: "png", Faces: &FaceOptions{
+		Cascade:     config.Faces.Cascade,
+		MinSize:     20,
+		MaxSize:     200,
+		ShiftFactor: 0.02,
+		ScaleFactor: 1.05,
+		Threshold:   1,
+	}}
+	res, err := sanitizeImage(&out, bytes.NewReader(in.Bytes()), opts, config)
+	if assert.NoError(t, err) {
+		assert.Len(t, res.Faces, 2)
+	}
+}
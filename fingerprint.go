@@ -0,0 +1,161 @@
+package main
+
+// This file contains the "anti-fingerprint" step, which makes it harder to
+// link a photo to the camera that took it.  Every camera sensor has a unique,
+// fixed pattern of slight differences in sensitivity between its pixels
+// (photo-response non-uniformity, or PRNU), which shows up as a faint noise
+// pattern in every photo it takes.  Matching that pattern against a reference
+// built from other photos identifies the camera, even with no metadata at all.
+//
+// Detection relies on the pattern being both present and aligned with the
+// reference, so we attack both:
+//
+//  1. The image is warped by a smooth, random displacement of a pixel or so,
+//     cropped very slightly and resampled to a random, non-integer smaller
+//     size.  Its pixels no longer line up with the sensor's - and because
+//     the warp varies across the image, no single shift or scale can line
+//     them up again - and each one mixes several of the original pixels.
+//  2. It is then smoothed to remove most of the remaining high-frequency
+//     noise, which is where the pattern lives...
+//  3. ... and fresh random noise is added, so that the result doesn't look
+//     unnaturally smooth, and so that anything left of the pattern is buried.
+//
+// This can't guarantee that a photo won't be linked to its camera, but it
+// lowers the correlation with the camera's reference pattern a great deal -
+// see TestFingerprintSuppression.
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"math/rand"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// The most that is cropped from each edge, as a fraction of the size.
+	fingerprintMaxCrop = 0.01
+
+	// The range of scales the image is resampled to.
+	fingerprintMinScale = 0.90
+	fingerprintMaxScale = 0.95
+
+	// The largest displacement of the warp, in pixels, and the range of its
+	// wavelengths, as fractions of the image's smaller side.
+	fingerprintWarp          = 1.5
+	fingerprintMinWavelength = 0.15
+	fingerprintMaxWavelength = 0.35
+
+	// The amount of smoothing, and the standard deviation of the noise
+	// that's added back, in 8-bit levels.
+	fingerprintBlur  = 1.2
+	fingerprintNoise = 3.0
+)
+
+// Returns a random number generator that is seeded securely, so that the
+// crop and scale can't be guessed.  If there's no secure seed to be had,
+// it's an error: a predictable one would undo the point.
+func newSecureRand() (*rand.Rand, error) {
+	var seed [8]byte
+	if _, err := io.ReadFull(crand.Reader, seed[:]); err != nil {
+		return nil, fmt.Errorf("could not seed random number generator: %s", err)
+	}
+	return rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:])))), nil
+}
+
+// Suppresses the sensor fingerprint in an image.  See the top of this file.
+func suppressFingerprint(img image.Image, rng *rand.Rand) *image.NRGBA {
+	b := img.Bounds()
+
+	// Crop a random sliver from each edge.
+	crop := func(size int) int {
+		return rng.Intn(int(float64(size)*fingerprintMaxCrop) + 1)
+	}
+	r := image.Rect(
+		b.Min.X+crop(b.Dx()), b.Min.Y+crop(b.Dy()),
+		b.Max.X-crop(b.Dx()), b.Max.Y-crop(b.Dy()),
+	)
+	cropped := warpImage(img, r, rng)
+
+	// Resample to a random scale.  Both dimensions use the same scale, so
+	// the aspect ratio is kept.
+	scale := fingerprintMinScale + rng.Float64()*(fingerprintMaxScale-fingerprintMinScale)
+	w := int(float64(r.Dx())*scale + 0.5)
+	h := int(float64(r.Dy())*scale + 0.5)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	out := imaging.Resize(cropped, w, h, imaging.Lanczos)
+
+	out = imaging.Blur(out, fingerprintBlur)
+
+	// Add new noise.  The same noise goes on each channel of a pixel, like
+	// the luminance noise of a real sensor.
+	for i := 0; i+3 < len(out.Pix); i += 4 {
+		n := int(rng.NormFloat64()*fingerprintNoise + 0.5)
+		for ch := 0; ch < 3; ch++ {
+			out.Pix[i+ch] = uint8(clampInt(int(out.Pix[i+ch])+n, 0, 0xff))
+		}
+	}
+
+	return out
+}
+
+// Returns the part r of img, warped by a random, smoothly varying
+// displacement of up to fingerprintWarp pixels.
+func warpImage(img image.Image, r image.Rectangle, rng *rand.Rand) *image.NRGBA {
+	src := imaging.Clone(img)
+	sb := src.Bounds()
+	minSide := math.Min(float64(sb.Dx()), float64(sb.Dy()))
+
+	// Each axis is displaced by the product of two waves, one along each
+	// axis, with random wavelengths and phases.
+	type wave struct{ freq, phase float64 }
+	newWave := func() wave {
+		length := minSide * (fingerprintMinWavelength +
+			rng.Float64()*(fingerprintMaxWavelength-fingerprintMinWavelength))
+		return wave{2 * math.Pi / length, rng.Float64() * 2 * math.Pi}
+	}
+	wx1, wx2, wy1, wy2 := newWave(), newWave(), newWave(), newWave()
+
+	dst := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			fx := float64(r.Min.X - sb.Min.X + x)
+			fy := float64(r.Min.Y - sb.Min.Y + y)
+			sx := fx + fingerprintWarp*math.Sin(wx1.freq*fx+wx1.phase)*math.Sin(wx2.freq*fy+wx2.phase)
+			sy := fy + fingerprintWarp*math.Sin(wy1.freq*fx+wy1.phase)*math.Sin(wy2.freq*fy+wy2.phase)
+			bilinear(src, sx, sy, dst.Pix[dst.PixOffset(x, y):])
+		}
+	}
+	return dst
+}
+
+// Samples an NRGBA image (whose bounds start at 0, 0) at a fractional
+// position, clamping to its edges, and writes the result to out.
+func bilinear(img *image.NRGBA, x, y float64, out []uint8) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	x = math.Max(0, math.Min(x, float64(w-1)))
+	y = math.Max(0, math.Min(y, float64(h-1)))
+
+	x0, y0 := int(x), int(y)
+	x1, y1 := clampInt(x0+1, 0, w-1), clampInt(y0+1, 0, h-1)
+	ax, ay := x-float64(x0), y-float64(y0)
+
+	p00 := img.Pix[img.PixOffset(x0, y0):]
+	p10 := img.Pix[img.PixOffset(x1, y0):]
+	p01 := img.Pix[img.PixOffset(x0, y1):]
+	p11 := img.Pix[img.PixOffset(x1, y1):]
+	for ch := 0; ch < 4; ch++ {
+		top := float64(p00[ch])*(1-ax) + float64(p10[ch])*ax
+		bottom := float64(p01[ch])*(1-ax) + float64(p11[ch])*ax
+		out[ch] = uint8(top*(1-ay) + bottom*ay + 0.5)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+)
+
+// This is a small harness for measuring how well suppressFingerprint hides a
+// camera's sensor pattern (PRNU).  It simulates cameras with known patterns,
+// builds a reference pattern for one from "photos" taken with it, and then
+// measures how strongly other photos correlate with that reference, using the
+// standard detector: the normalized correlation between the noise residual of
+// a photo and the reference pattern modulated by the photo.
+
+const prnuSize = 256
+
+// A simulated camera: each pixel's sensitivity is off by a fixed random
+// amount, and every photo gets some random shot noise too.
+type prnuCamera struct {
+	pattern []float64
+	rng     *rand.Rand
+}
+
+func newPRNUCamera(seed int64) *prnuCamera {
+	rng := rand.New(rand.NewSource(seed))
+	c := &prnuCamera{pattern: make([]float64, prnuSize*prnuSize), rng: rng}
+	for i := range c.pattern {
+		c.pattern[i] = rng.NormFloat64() * 0.03
+	}
+	return c
+}
+
+// Returns a random scene: smooth gradients and waves, with some texture if
+// flat is false.
+func prnuScene(rng *rand.Rand, flat bool) []float64 {
+	scene := make([]float64, prnuSize*prnuSize)
+	gx, gy := rng.Float64()*60-30, rng.Float64()*60-30
+	fx, fy := rng.Float64()*0.1, rng.Float64()*0.1
+	amp := 0.0
+	if !flat {
+		amp = 40
+	}
+	for y := 0; y < prnuSize; y++ {
+		for x := 0; x < prnuSize; x++ {
+			v := 128 + gx*float64(x)/prnuSize + gy*float64(y)/prnuSize
+			v += amp * math.Sin(fx*float64(x)) * math.Cos(fy*float64(y))
+			scene[y*prnuSize+x] = v
+		}
+	}
+	return scene
+}
+
+// Takes a photo of a scene.
+func (c *prnuCamera) shoot(scene []float64) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, prnuSize, prnuSize))
+	for i, v := range scene {
+		v = v*(1+c.pattern[i]) + c.rng.NormFloat64()*1.5
+		img.Pix[i] = uint8(math.Max(0, math.Min(255, v+0.5)))
+	}
+	return img
+}
+
+// Returns the luma of an image, and its noise residual: the image minus a
+// denoised copy of it.
+func prnuResidual(img image.Image) ([]float64, []float64) {
+	b := img.Bounds()
+	smooth := imaging.Blur(img, 1)
+	luma := make([]float64, b.Dx()*b.Dy())
+	residual := make([]float64, b.Dx()*b.Dy())
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			v := float64(color.GrayModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y)
+			s := float64(color.GrayModel.Convert(smooth.At(x, y)).(color.Gray).Y)
+			luma[y*b.Dx()+x] = v
+			residual[y*b.Dx()+x] = v - s
+		}
+	}
+	return luma, residual
+}
+
+// Estimates a camera's pattern from some of its photos.
+func prnuReference(photos []image.Image) []float64 {
+	num := make([]float64, prnuSize*prnuSize)
+	den := make([]float64, prnuSize*prnuSize)
+	for _, p := range photos {
+		luma, residual := prnuResidual(p)
+		for i := range num {
+			num[i] += residual[i] * luma[i]
+			den[i] += luma[i] * luma[i]
+		}
+	}
+	for i := range num {
+		num[i] /= den[i]
+	}
+	return num
+}
+
+func normalizedCorrelation(a, b []float64) float64 {
+	var ma, mb float64
+	for i := range a {
+		ma += a[i]
+		mb += b[i]
+	}
+	ma /= float64(len(a))
+	mb /= float64(len(b))
+
+	var ab, aa, bb float64
+	for i := range a {
+		da, db := a[i]-ma, b[i]-mb
+		ab += da * db
+		aa += da * da
+		bb += db * db
+	}
+	return ab / math.Sqrt(aa*bb)
+}
+
+// Returns how strongly a photo correlates with a reference pattern.  Photos
+// that aren't the same size as the reference are scaled back up to it, and
+// then the best of a few small shifts is used, as someone trying to match a
+// processed photo would.
+func prnuCorrelation(reference []float64, photo image.Image) float64 {
+	if photo.Bounds().Dx() != prnuSize || photo.Bounds().Dy() != prnuSize {
+		photo = imaging.Resize(photo, prnuSize, prnuSize, imaging.Lanczos)
+	}
+	luma, residual := prnuResidual(photo)
+
+	const maxShift = 3
+	const inner = prnuSize - 2*maxShift
+	best := math.Inf(-1)
+	for dy := -maxShift; dy <= maxShift; dy++ {
+		for dx := -maxShift; dx <= maxShift; dx++ {
+			var a, b []float64
+			for y := maxShift; y < maxShift+inner; y++ {
+				for x := maxShift; x < maxShift+inner; x++ {
+					i := y*prnuSize + x
+					j := (y+dy)*prnuSize + x + dx
+					a = append(a, residual[i])
+					b = append(b, reference[j]*luma[i])
+				}
+			}
+			if c := normalizedCorrelation(a, b); c > best {
+				best = c
+			}
+		}
+	}
+	return best
+}
+
+func TestFingerprintSuppression(t *testing.T) {
+	if testing.Short() {
+		t.Skip("slow")
+	}
+
+	camera := newPRNUCamera(1)
+	other := newPRNUCamera(2)
+	rng := rand.New(rand.NewSource(3))
+
+	var flats []image.Image
+	for i := 0; i < 20; i++ {
+		flats = append(flats, camera.shoot(prnuScene(rng, true)))
+	}
+	reference := prnuReference(flats)
+
+	var same, otherCamera, suppressed float64
+	const trials = 3
+	for i := 0; i < trials; i++ {
+		scene := prnuScene(rng, false)
+		photo := camera.shoot(scene)
+
+		same += prnuCorrelation(reference, photo) / trials
+		otherCamera += prnuCorrelation(reference, other.shoot(scene)) / trials
+		suppressed += prnuCorrelation(reference, suppressFingerprint(photo, rng)) / trials
+	}
+
+	t.Logf("correlation with the reference: same camera %.4f, other camera %.4f, suppressed %.4f",
+		same, otherCamera, suppressed)
+
+	// The detector works on unprocessed photos...
+	assert.True(t, same > 0.1, "same camera: %f", same)
+	assert.True(t, otherCamera < same/5, "other camera: %f", otherCamera)
+
+	// ... but suppressed ones look much more like they came from another
+	// camera.
+	assert.True(t, suppressed < same/5, "suppressed: %f", suppressed)
+	assert.True(t, suppressed < 2*math.Max(otherCamera, 0.01), "suppressed: %f", suppressed)
+}
+
+func TestSuppressFingerprintSize(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 500))
+	out := suppressFingerprint(img, rand.New(rand.NewSource(1)))
+
+	w, h := out.Bounds().Dx(), out.Bounds().Dy()
+	assert.True(t, w >= 880 && w <= 950, "width %d", w)
+	assert.InDelta(t, 2.0, float64(w)/float64(h), 0.02)
+
+	tiny := suppressFingerprint(image.NewRGBA(image.Rect(0, 0, 1, 1)), rand.New(rand.NewSource(1)))
+	assert.Equal(t, image.Pt(1, 1), tiny.Bounds().Size())
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("no entropy")
+}
+
+func TestSecureRandError(t *testing.T) {
+	defer func(r io.Reader) { crand.Reader = r }(crand.Reader)
+	crand.Reader = failingReader{}
+
+	// Nothing that needs unpredictable noise goes ahead without it.
+	_, err := newSecureRand()
+	assert.Error(t, err)
+	img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	assert.Error(t, applyRedactions(img, []Redaction{{0, 0, 50, 50, "pixelate"}}))
+}
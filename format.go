@@ -0,0 +1,182 @@
+package main
+
+// This file contains the "best" output format policy.  Instead of keeping the
+// format an image was uploaded in, we try the encodings that suit its content
+// and keep whichever is smallest: screenshots uploaded as JPEG come out as
+// PNG, and photos uploaded as PNG come out as JPEG.
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// The most colors an image can have and still be considered "flat" - i.e. a
+// screenshot, diagram or similar, rather than a photograph.  Flat images are
+// always stored losslessly.
+const maxFlatColors = 256
+
+var errTooLarge = errors.New("encoded image is larger than the best so far")
+
+// Picks the best format for img, and encodes it into w.  See encodeImage.
+func encodeBest(w io.Writer, img image.Image, source io.ReadSeeker, res *SanitizeResult, opts *SanitizeOptions) error {
+	hasAlpha, palette := analyzeColors(img)
+
+	// JPEG can't store transparency, and would smear the sharp edges of a
+	// flat image, so only photographic images get to try it.
+	var candidates []string
+	var paletted image.Image
+	switch {
+	case palette != nil:
+		candidates = []string{"png"}
+		paletted = toPaletted(img, palette)
+	case hasAlpha:
+		candidates = []string{"png"}
+	default:
+		candidates = []string{"jpeg", "png"}
+	}
+
+	var best []byte
+	var bestRes SanitizeResult
+	for _, format := range candidates {
+		candidate := *res
+		candidate.Format = format
+
+		toEncode := img
+		if format == "png" && paletted != nil {
+			toEncode = paletted
+		}
+
+		// Give up on this candidate as soon as it's bigger than what we have.
+		var buf bytes.Buffer
+		out := &limitedWriter{w: &buf, limit: -1}
+		if best != nil {
+			out.limit = len(best)
+		}
+
+		err := encodeImage(out, toEncode, source, &candidate, opts)
+		if out.exceeded {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if best == nil || buf.Len() < len(best) {
+			best = buf.Bytes()
+			bestRes = candidate
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"source_format": res.SourceFormat,
+		"format":        bestRes.Format,
+		"flat":          palette != nil,
+		"alpha":         hasAlpha,
+	}).Debug("picked best format")
+
+	*res = bestRes
+	_, err := w.Write(best)
+	return err
+}
+
+// Looks at the pixels of an image, returning whether any of them are
+// transparent and - if it has no more than maxFlatColors distinct colors -
+// its palette.
+func analyzeColors(img image.Image) (bool, color.Palette) {
+	b := img.Bounds()
+	hasAlpha := false
+	seen := make(map[color.NRGBA]struct{})
+
+	add := func(c color.NRGBA) {
+		if c.A != 0xff {
+			hasAlpha = true
+		}
+		if seen != nil {
+			seen[c] = struct{}{}
+			if len(seen) > maxFlatColors {
+				seen = nil
+			}
+		}
+	}
+
+	switch src := img.(type) {
+	case *image.RGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, y):]
+			for x := 0; x < b.Dx(); x++ {
+				c := color.RGBA{row[4*x], row[4*x+1], row[4*x+2], row[4*x+3]}
+				if c.A == 0xff {
+					add(color.NRGBA{c.R, c.G, c.B, c.A})
+				} else {
+					add(color.NRGBAModel.Convert(c).(color.NRGBA))
+				}
+			}
+		}
+	case *image.NRGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, y):]
+			for x := 0; x < b.Dx(); x++ {
+				add(color.NRGBA{row[4*x], row[4*x+1], row[4*x+2], row[4*x+3]})
+			}
+		}
+	default:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				add(color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA))
+			}
+		}
+	}
+
+	if seen == nil {
+		return hasAlpha, nil
+	}
+
+	palette := make(color.Palette, 0, len(seen))
+	for c := range seen {
+		palette = append(palette, c)
+	}
+	return hasAlpha, palette
+}
+
+// Converts an image to a paletted one, given a palette that contains every
+// color in it.  This is much faster than image/draw, which searches the
+// palette for the nearest match to each pixel.
+func toPaletted(img image.Image, palette color.Palette) *image.Paletted {
+	index := make(map[color.NRGBA]uint8, len(palette))
+	for i, c := range palette {
+		index[c.(color.NRGBA)] = uint8(i)
+	}
+
+	b := img.Bounds()
+	dst := image.NewPaletted(b, palette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			dst.SetColorIndex(x, y, index[c])
+		}
+	}
+	return dst
+}
+
+// limitedWriter fails with errTooLarge once more than limit bytes have been
+// written to it.  A negative limit means there is no limit.
+type limitedWriter struct {
+	w        io.Writer
+	n        int
+	limit    int
+	exceeded bool
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.limit >= 0 && l.n+len(p) > l.limit {
+		l.exceeded = true
+		return 0, errTooLarge
+	}
+	n, err := l.w.Write(p)
+	l.n += n
+	return n, err
+}
@@ -5,97 +5,395 @@ import (
 	"encoding/binary"
 	"fmt"
 	"image"
+	"image/color"
 	"image/draw"
-	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
 
+	_ "code.google.com/p/go.image/tiff"
 	"github.com/Sirupsen/logrus"
 	"github.com/disintegration/imaging"
 	"github.com/rwcarlsen/goexif/exif"
 	"github.com/rwcarlsen/goexif/tiff"
 )
 
-func checkImage(r io.ReadSeeker) (string, bool) {
-	_, fmt, err := image.Decode(r)
+// Returns the format to publish an image in, given the format asked for (if
+// any) and the one it was uploaded in.  Browsers can't show TIFFs, so they
+// are published as PNG, which loses nothing.
+func outputFormat(format, source string) string {
+	switch {
+	case len(format) > 0:
+		return format
+	case source == "tiff":
+		return "png"
+	}
+	return source
+}
+
+// Returns whether the input starts like a TIFF file, without parsing any of
+// it.
+func isTIFF(r io.ReadSeeker) bool {
+	var magic [4]byte
+	_, err := io.ReadFull(r, magic[:])
+	r.Seek(0, 0)
+	return err == nil && (string(magic[:]) == "II*\x00" || string(magic[:]) == "MM\x00*")
+}
+
+// Checks that the input looks like an image, returning its header and format.
+// Only the header is read here - the full decode happens when the image is
+// sanitized.
+func checkImage(r io.ReadSeeker) (image.Config, string, bool) {
+	cfg, fmt, err := image.DecodeConfig(r)
 	_, err2 := r.Seek(0, 0)
-	if err != nil || err2 != nil {
-		return "", false
+	if err != nil || err2 != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+		return image.Config{}, "", false
+	}
+
+	return cfg, fmt, true
+}
+
+// SanitizeOptions controls how SanitizeImageFrom re-encodes an image.  It is
+// serialized to JSON when sanitizing in a sandboxed child process.
+type SanitizeOptions struct {
+	// The format to encode the image as.  If empty, the format of the source
+	// is used; if "best", encodeBest picks one.
+	Format string `json:"format"`
+
+	// How to pick the quality JPEGs are encoded with - one of "fixed",
+	// "preserve", "max_size" or "min_ssim".  See the sample config for
+	// details.
+	JPEGMode string `json:"jpeg_mode"`
+
+	// The quality to encode JPEG images with in "fixed" mode, or if we can't
+	// tell what the quality of the source was in "preserve" mode.
+	JPEGQuality int `json:"jpeg_quality"`
+
+	// The range of qualities that the other modes may choose from.
+	MinJPEGQuality int `json:"min_jpeg_quality"`
+	MaxJPEGQuality int `json:"max_jpeg_quality"`
+
+	// The targets for "max_size" and "min_ssim" modes.
+	JPEGMaxBytes int64   `json:"jpeg_max_bytes"`
+	JPEGMinSSIM  float64 `json:"jpeg_min_ssim"`
+
+	// The color transparent images are flattened onto when they are encoded
+	// as JPEG, which has no alpha channel.  If nil, white is used.
+	Background *color.NRGBA `json:"background,omitempty"`
+
+	// The largest size the output may be.  Larger images are scaled down to
+	// fit, keeping their aspect ratio.  Zero means there is no limit.
+	MaxWidth  int `json:"max_width"`
+	MaxHeight int `json:"max_height"`
+
+	// Regions of the image to redact.
+	Redactions []Redaction `json:"redactions,omitempty"`
+
+	// If set, faces are found and pixelated.
+	Faces *FaceOptions `json:"faces,omitempty"`
+
+	// If both are given, the image is cropped to this aspect ratio before
+	// anything else is done to it.
+	AspectWidth  int `json:"aspect_width,omitempty"`
+	AspectHeight int `json:"aspect_height,omitempty"`
+
+	// How to crop the image to the aspect ratio above: "center" or "smart"
+	// (see smartCropRect).  SmartCropSkin makes smart crops prefer areas of
+	// skin.
+	Crop          string `json:"crop,omitempty"`
+	SmartCropSkin bool   `json:"smart_crop_skin,omitempty"`
+
+	// Whether to suppress the camera's sensor fingerprint (see
+	// suppressFingerprint).
+	AntiFingerprint bool `json:"anti_fingerprint,omitempty"`
+
+	// If set, the published image is watermarked.
+	Watermark *WatermarkOptions `json:"watermark,omitempty"`
+
+	// Smaller copies of the image to produce alongside it.
+	Renditions []RenditionSpec `json:"renditions,omitempty"`
+
+	// Whether to dither images that have to be quantized to be stored as GIF.
+	GIFDither bool `json:"gif_dither"`
+}
+
+// SanitizeResult describes the output of SanitizeImageFrom.
+type SanitizeResult struct {
+	SourceFormat string `json:"source_format"`
+	Format       string `json:"format"`
+	Size         int64  `json:"size"`
+
+	// The dimensions of the output, and whether it had to be scaled down.
+	Width   int  `json:"width"`
+	Height  int  `json:"height"`
+	Resized bool `json:"resized,omitempty"`
+
+	// The perceptual hash of the image (see dHash), before it was scaled
+	// down or watermarked.
+	PerceptualHash perceptualHash `json:"perceptual_hash"`
+
+	// A placeholder for clients to show while the image loads.
+	Placeholder *Placeholder `json:"placeholder,omitempty"`
+
+	// The faces that were found and redacted, in the coordinates of the
+	// output image.  Faces that were cropped away aren't listed.
+	Faces []FaceBox `json:"faces,omitempty"`
+
+	// The renditions given in the options, encoded in the same format as the
+	// main image.
+	Renditions []Rendition `json:"renditions,omitempty"`
+
+	// For JPEGs, the quality estimated for the source (0 if unknown) and the
+	// quality the output was encoded with.
+	EstimatedQuality int `json:"estimated_quality,omitempty"`
+	Quality          int `json:"quality,omitempty"`
+
+	// For JPEGs encoded to a size or similarity target, the SSIM of the
+	// output (min_ssim only) and whether the target could be met.
+	SSIM      float64 `json:"ssim,omitempty"`
+	TargetMet bool    `json:"target_met,omitempty"`
+}
+
+func SanitizeImageFrom(r io.ReadSeeker, opts *SanitizeOptions) (io.ReadSeeker, *SanitizeResult, error) {
+	var buf bytes.Buffer
+	res, err := SanitizeImageTo(&buf, r, opts)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return fmt, true
+	// Convert to a byte slice, and then to our ReadSeeker.
+	return bytes.NewReader(buf.Bytes()), res, nil
 }
 
-// Note: comp is used for JSON compression
-func SanitizeImageFrom(r io.ReadSeeker, comp int) (io.ReadSeeker, int64, error) {
+// SanitizeImageTo is like SanitizeImageFrom, but streams the encoded image
+// into w as it is produced rather than collecting it in memory first.
+func SanitizeImageTo(w io.Writer, r io.ReadSeeker, opts *SanitizeOptions) (*SanitizeResult, error) {
 	img, format, err := image.Decode(r)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+
+	res := &SanitizeResult{SourceFormat: format}
+
+	// Remember the palette of paletted images, so that we don't need to
+	// quantize them again if they are saved as GIF.
+	var palette color.Palette
+	if p, ok := img.(*image.Paletted); ok {
+		palette = p.Palette
 	}
 
 	var orientation *tiff.Tag
-	var ex *exif.Exif
+	var order binary.ByteOrder
 
 	_, err = r.Seek(0, 0)
 	if err != nil {
 		log.WithField("err", err).Error("Cannot rewind image to parse EXIF")
-	} else if format == "jpeg" {
-		ex, err = parseExif(r)
-
-		canContinue := true
-		if err != nil {
-			if exif.IsCriticalError(err) {
-				log.WithFields(logrus.Fields{
-					"error": err,
-				}).Error("Could not parse EXIF data from image")
-				canContinue = false
-			} else {
-				log.WithFields(logrus.Fields{
-					"error": err,
-				}).Warn("Non-fatal error when parsing EXIF data")
-			}
-		}
-
-		if canContinue {
-			orientation, err = ex.Get(exif.Orientation)
-			if err != nil && !exif.IsTagNotPresentError(err) {
-				log.WithFields(logrus.Fields{
-					"error": err,
-				}).Warn("Could not get Orientation tag")
-			}
-		}
+	} else {
+		orientation, order = readOrientation(r, format)
 	}
 
 	log.WithFields(logrus.Fields{
 		"format": format,
 	}).Debug("Sanitizing image")
 	newImg := CloneToRGBA(img)
+	img = nil
 
 	if orientation != nil {
-		newImg, err = fixOrientation(newImg, orientation, ex.Tiff.Order)
+		rotated, err := fixOrientation(newImg, orientation, order)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err,
+			}).Warn("Could not apply orientation")
+		} else {
+			newImg = rotated
+		}
 	}
 
-	// Encode as the original type into a buffer
-	var buf bytes.Buffer
-	switch format {
+	// Redact before anything else is made from the image, so that nothing
+	// we publish has the original pixels in it.
+	redactions := opts.Redactions
+	if opts.Faces != nil {
+		res.Faces, err = detectFaces(newImg, opts.Faces)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range res.Faces {
+			redactions = append(redactions, faceRedaction(f))
+		}
+	}
+	if len(redactions) > 0 {
+		rgba, ok := newImg.(*image.RGBA)
+		if !ok {
+			rgba = CloneToRGBA(newImg).(*image.RGBA)
+		}
+		if err := applyRedactions(rgba, redactions); err != nil {
+			return nil, err
+		}
+		newImg = rgba
+	}
+
+	// The faces are reported where they are in the output, so they follow
+	// the image through everything that changes its size from here on.
+	if opts.AspectWidth > 0 && opts.AspectHeight > 0 {
+		rect := aspectCropRect(newImg, opts.AspectWidth, opts.AspectHeight, opts.Crop, opts.SmartCropSkin)
+		res.Faces = mapFaces(res.Faces, rect, rect.Size())
+		newImg = cropToRect(newImg, rect)
+	}
+
+	if opts.AntiFingerprint {
+		// The exact crop and scale are meant to be secret, so the faces
+		// are only scaled with the image as a whole, which puts them
+		// within a few pixels of where they ended up.
+		rng, err := newSecureRand()
+		if err != nil {
+			return nil, err
+		}
+		b := newImg.Bounds()
+		newImg = suppressFingerprint(newImg, rng)
+		res.Faces = mapFaces(res.Faces, b, newImg.Bounds().Size())
+	}
+
+	full := newImg
+	res.PerceptualHash = dHash(full)
+	newImg, res.Resized = fitImage(newImg, opts.MaxWidth, opts.MaxHeight)
+	res.Faces = mapFaces(res.Faces, full.Bounds(), newImg.Bounds().Size())
+
+	// Renditions are made from the scaled image, so that none of them is
+	// larger than the maximum size either, but before it is watermarked.
+	scaled := newImg
+	if opts.Watermark != nil {
+		newImg, err = applyWatermark(newImg, opts.Watermark)
+		if err != nil {
+			return nil, err
+		}
+	}
+	res.Width, res.Height = newImg.Bounds().Dx(), newImg.Bounds().Dy()
+
+	res.Placeholder, err = makePlaceholder(newImg, opts.Background)
+	if err != nil {
+		return nil, err
+	}
+
+	outFormat := outputFormat(opts.Format, format)
+	if outFormat == "gif" && palette != nil {
+		if p, ok := repalette(newImg, palette); ok {
+			newImg = p
+		}
+	}
+
+	cw := &countingWriter{w: w}
+	if outFormat == "best" {
+		err = encodeBest(cw, newImg, r, res, opts)
+	} else {
+		res.Format = outFormat
+		err = encodeImage(cw, newImg, r, res, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Size = cw.n
+
+	if len(opts.Renditions) > 0 {
+		res.Renditions, err = makeRenditions(scaled, r, res, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// Encodes img into w in the format given by res.Format, filling in the
+// details of the encoding in res.  The source is needed to estimate the
+// quality of JPEGs.
+func encodeImage(w io.Writer, img image.Image, source io.ReadSeeker, res *SanitizeResult, opts *SanitizeOptions) error {
+	switch res.Format {
 	case "gif":
-		err = gif.Encode(&buf, newImg, &gif.Options{NumColors: 256})
+		return encodeGIF(w, img, opts.GIFDither)
 	case "jpeg":
-		err = jpeg.Encode(&buf, newImg, &jpeg.Options{Quality: comp})
+		img = flatten(img, opts.Background)
+		if opts.JPEGMode == "max_size" || opts.JPEGMode == "min_ssim" {
+			data, quality, ssim, met, err := encodeJPEGToTarget(img, opts)
+			if err != nil {
+				return err
+			}
+			res.Quality, res.SSIM, res.TargetMet = quality, ssim, met
+
+			_, err = w.Write(data)
+			return err
+		}
+
+		res.EstimatedQuality, res.Quality = chooseJPEGQuality(source, res.SourceFormat, opts)
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: res.Quality})
 	case "png":
-		err = png.Encode(&buf, newImg)
-	default:
-		return nil, 0, fmt.Errorf("unknown image format: %s", format)
+		return png.Encode(w, img)
 	}
 
+	return fmt.Errorf("unknown image format: %s", res.Format)
+}
+
+// Picks the quality to re-encode a JPEG with, returning the quality estimated
+// for the source (if any) and the one chosen.
+func chooseJPEGQuality(r io.ReadSeeker, sourceFormat string, opts *SanitizeOptions) (int, int) {
+	if opts.JPEGMode != "preserve" || sourceFormat != "jpeg" {
+		return 0, opts.JPEGQuality
+	}
+
+	estimated, err := estimateJPEGQuality(r)
 	if err != nil {
-		return nil, 0, err
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Could not estimate JPEG quality")
+		return 0, opts.JPEGQuality
 	}
 
-	// Convert to a byte slice, and then to our ReadSeeker.
-	bSlice := buf.Bytes()
-	return bytes.NewReader(bSlice), int64(len(bSlice)), nil
+	return estimated, clampInt(estimated, opts.MinJPEGQuality, opts.MaxJPEGQuality)
+}
+
+// Scales an image down to fit within the given size, if it doesn't already.
+// A zero width or height means that dimension isn't limited.  Returns whether
+// the image was scaled.
+func fitImage(img image.Image, maxWidth, maxHeight int) (image.Image, bool) {
+	b := img.Bounds()
+	if maxWidth <= 0 {
+		maxWidth = b.Dx()
+	}
+	if maxHeight <= 0 {
+		maxHeight = b.Dy()
+	}
+	if b.Dx() <= maxWidth && b.Dy() <= maxHeight {
+		return img, false
+	}
+
+	log.WithFields(logrus.Fields{
+		"width":      b.Dx(),
+		"height":     b.Dy(),
+		"max_width":  maxWidth,
+		"max_height": maxHeight,
+	}).Debug("Scaling image down")
+	return imaging.Fit(img, maxWidth, maxHeight, imaging.Lanczos), true
+}
+
+// Composites an image over a solid background color, so that it has no
+// transparent pixels left.  Images that are already opaque are returned as-is.
+func flatten(img image.Image, background *color.NRGBA) image.Image {
+	if opaque, ok := img.(interface {
+		Opaque() bool
+	}); ok && opaque.Opaque() {
+		return img
+	}
+
+	bg := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	if background != nil {
+		bg = *background
+		bg.A = 0xff
+	}
+
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.NewUniform(bg), image.ZP, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+	return dst
 }
 
 func CloneToRGBA(src image.Image) image.Image {
@@ -105,17 +403,114 @@ func CloneToRGBA(src image.Image) image.Image {
 	return dst
 }
 
+// Parses EXIF data from a JPEG or TIFF file.  Note that the returned Exif may
+// still be usable if the error is not critical.
 func parseExif(r io.ReadSeeker) (*exif.Exif, error) {
 	ex, err := exif.Decode(r)
 	_, err2 := r.Seek(0, 0)
 
+	if err2 != nil {
+		return nil, err2
+	}
+
+	return ex, err
+}
+
+// Reads the EXIF data from an image, from wherever its format stores it.
+// Returns nil if the format can't contain EXIF data.
+//
+// Note that we can't decode WebP or HEIF images, so anything converted from
+// them will arrive as one of the formats below.
+func readExif(r io.ReadSeeker, format string) (*exif.Exif, error) {
+	switch format {
+	case "jpeg", "tiff":
+		// goexif understands both the JPEG APP1 segment and bare TIFF files.
+		return parseExif(r)
+
+	case "png":
+		// PNG stores a TIFF-formatted EXIF blob in an "eXIf" chunk.
+		data, err := findPNGChunk(r, "eXIf")
+		if err != nil || data == nil {
+			return nil, err
+		}
+		return parseExif(bytes.NewReader(data))
+	}
+
+	return nil, nil
+}
+
+// Finds the orientation tag of an image, along with the byte order needed to
+// read it.  Returns a nil tag if the image has no orientation.
+func readOrientation(r io.ReadSeeker, format string) (*tiff.Tag, binary.ByteOrder) {
+	ex, err := readExif(r, format)
 	if err != nil {
+		if ex == nil || exif.IsCriticalError(err) {
+			log.WithFields(logrus.Fields{
+				"error":  err,
+				"format": format,
+			}).Error("Could not parse EXIF data from image")
+			return nil, nil
+		}
+
+		log.WithFields(logrus.Fields{
+			"error":  err,
+			"format": format,
+		}).Warn("Non-fatal error when parsing EXIF data")
+	}
+	if ex == nil {
+		return nil, nil
+	}
+
+	orientation, err := ex.Get(exif.Orientation)
+	if err != nil {
+		if !exif.IsTagNotPresentError(err) {
+			log.WithFields(logrus.Fields{
+				"error": err,
+			}).Warn("Could not get Orientation tag")
+		}
+		return nil, nil
+	}
+
+	return orientation, ex.Tiff.Order
+}
+
+// Finds the first chunk of the given type in a PNG file and returns its
+// contents, or nil if there's no such chunk.  The reader is rewound
+// afterwards.
+func findPNGChunk(r io.ReadSeeker, typ string) ([]byte, error) {
+	defer r.Seek(0, 0)
+
+	// Skip the 8-byte signature.
+	if _, err := r.Seek(8, 0); err != nil {
 		return nil, err
-	} else if err2 != nil {
-		return nil, err2
 	}
 
-	return ex, nil
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+
+		switch chunkType {
+		case typ:
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			return data, nil
+
+		case "IEND":
+			return nil, nil
+		}
+
+		// Skip the data and CRC.
+		if _, err := r.Seek(length+4, 1); err != nil {
+			return nil, err
+		}
+	}
 }
 
 func fixOrientation(img image.Image, orientation *tiff.Tag, order binary.ByteOrder) (image.Image, error) {
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"image/jpeg"
+	"image/png"
+	"math"
 	"os"
 	"path"
+	"strings"
 	"testing"
 
+	"github.com/disintegration/imaging"
 	"github.com/rwcarlsen/goexif/exif"
 	"github.com/stretchr/testify/assert"
 )
@@ -40,7 +47,7 @@ func TestImageOrientation(t *testing.T) {
 		assert.NoError(t, err)
 		defer f.Close()
 
-		img, _, err := image.Decode(f)
+		img, format, err := image.Decode(f)
 		assert.NoError(t, err)
 
 		newImg := CloneToRGBA(img)
@@ -48,16 +55,26 @@ func TestImageOrientation(t *testing.T) {
 		_, err = f.Seek(0, 0)
 		assert.NoError(t, err)
 
-		ex, err := parseExif(f)
-		assert.NoError(t, err)
+		orientation, order := readOrientation(f, format)
+		if !assert.NotNil(t, orientation, "no orientation in %s", fname) {
+			continue
+		}
 
-		orientation, err := ex.Get(exif.Orientation)
+		newImg, err = fixOrientation(newImg, orientation, order)
 		assert.NoError(t, err)
 
-		newImg, err = fixOrientation(newImg, orientation, ex.Tiff.Order)
-		assert.NoError(t, err)
+		// All of the test images are landscape once they're rotated
+		// correctly.
+		if strings.HasPrefix(fname, "Landscape_") {
+			b := newImg.Bounds()
+			assert.True(t, b.Dx() > b.Dy(), "%s is not landscape", fname)
+		}
 
-		outFile, err := os.Create(path.Join("exif-orientation-processed", "processed-"+fname))
+		outName := "processed-" + fname
+		if format != "jpeg" {
+			outName += ".jpg"
+		}
+		outFile, err := os.Create(path.Join("exif-orientation-processed", outName))
 		assert.NoError(t, err)
 
 		err = jpeg.Encode(outFile, newImg, &jpeg.Options{Quality: 100})
@@ -101,3 +118,318 @@ func TestImageCompression(t *testing.T) {
 		assert.NoError(t, err)
 	}
 }
+
+// Returns the mean absolute difference between the pixels of two images, after
+// scaling them to the same small size.
+func imageDifference(a, b image.Image) float64 {
+	const w, h = 32, 24
+	sa := imaging.Resize(a, w, h, imaging.Box)
+	sb := imaging.Resize(b, w, h, imaging.Box)
+
+	var total float64
+	for i := range sa.Pix {
+		total += math.Abs(float64(sa.Pix[i]) - float64(sb.Pix[i]))
+	}
+	return total / float64(len(sa.Pix))
+}
+
+func TestSanitizeOrientationFormats(t *testing.T) {
+	// Every one of the test images should end up looking like this one.
+	ref, err := imaging.Open("exif-orientation-examples/Landscape_1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ext := range []string{"jpg", "png", "tiff"} {
+		for i := 1; i <= 8; i++ {
+			fname := fmt.Sprintf("exif-orientation-examples/Landscape_%d.%s", i, ext)
+
+			f, err := os.Open(fname)
+			if !assert.NoError(t, err) {
+				continue
+			}
+
+			out, _, err := SanitizeImageFrom(f, &SanitizeOptions{JPEGQuality: 80})
+			f.Close()
+			if !assert.NoError(t, err, fname) {
+				continue
+			}
+
+			img, _, err := image.Decode(out)
+			if assert.NoError(t, err, fname) {
+				diff := imageDifference(ref, img)
+				assert.True(t, diff < 20, "%s is not oriented correctly (difference %f)", fname, diff)
+			}
+		}
+	}
+}
+
+func TestSanitizeTIFF(t *testing.T) {
+	f, err := os.Open("exif-orientation-examples/Landscape_1.tiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	assert.True(t, isTIFF(f))
+
+	// TIFFs are published as PNG, unless something else is asked for.
+	out, res, err := SanitizeImageFrom(f, &SanitizeOptions{JPEGQuality: 80})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "png", res.Format)
+		_, format, err := image.Decode(out)
+		assert.NoError(t, err)
+		assert.Equal(t, "png", format)
+	}
+	assert.Equal(t, "jpeg", outputFormat("jpeg", "tiff"))
+	assert.Equal(t, "gif", outputFormat("", "gif"))
+
+	jpg, err := os.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jpg.Close()
+	assert.False(t, isTIFF(jpg))
+}
+
+func TestEstimateJPEGQuality(t *testing.T) {
+	f, err := os.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, quality := range []int{10, 30, 50, 75, 80, 90, 95, 100} {
+		var buf bytes.Buffer
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		assert.NoError(t, err)
+
+		estimated, err := estimateJPEGQuality(bytes.NewReader(buf.Bytes()))
+		if assert.NoError(t, err) {
+			assert.InDelta(t, quality, estimated, 2, "quality %d", quality)
+		}
+	}
+
+	_, err = estimateJPEGQuality(bytes.NewReader([]byte("not a jpeg")))
+	assert.Error(t, err)
+}
+
+func TestPreserveJPEGQuality(t *testing.T) {
+	opts := &SanitizeOptions{
+		JPEGMode:       "preserve",
+		JPEGQuality:    80,
+		MinJPEGQuality: 60,
+		MaxJPEGQuality: 90,
+	}
+
+	f, err := os.Open("exif-orientation-examples/Landscape_1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	estimated, err := estimateJPEGQuality(f)
+	assert.NoError(t, err)
+
+	_, res, err := SanitizeImageFrom(f, opts)
+	if assert.NoError(t, err) {
+		assert.Equal(t, estimated, res.EstimatedQuality)
+		assert.Equal(t, clampInt(estimated, 60, 90), res.Quality)
+	}
+}
+
+func TestJPEGTargets(t *testing.T) {
+	img, err := imaging.Open("exif-orientation-examples/compression-test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img = imaging.Resize(img, 800, 0, imaging.Lanczos)
+
+	opts := &SanitizeOptions{
+		JPEGMode:       "max_size",
+		MinJPEGQuality: 10,
+		MaxJPEGQuality: 95,
+		JPEGMaxBytes:   50 * 1024,
+	}
+	data, quality, _, met, err := encodeJPEGToTarget(img, opts)
+	if assert.NoError(t, err) {
+		assert.True(t, met)
+		assert.True(t, len(data) <= 50*1024)
+		assert.True(t, quality < 95)
+	}
+
+	// Can't possibly get this small.
+	opts.JPEGMaxBytes = 10
+	data, quality, _, met, err = encodeJPEGToTarget(img, opts)
+	if assert.NoError(t, err) {
+		assert.False(t, met)
+		assert.Equal(t, 10, quality)
+	}
+
+	opts = &SanitizeOptions{
+		JPEGMode:       "min_ssim",
+		MinJPEGQuality: 10,
+		MaxJPEGQuality: 95,
+		JPEGMinSSIM:    0.9,
+	}
+	data, quality, ssim, met, err := encodeJPEGToTarget(img, opts)
+	if assert.NoError(t, err) {
+		assert.True(t, met)
+		assert.True(t, ssim >= 0.9)
+		assert.True(t, quality > 10 && quality < 95)
+	}
+}
+
+func TestSSIM(t *testing.T) {
+	img, err := imaging.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	luma := newLumaPlane(img)
+	assert.InDelta(t, 1.0, luma.SSIM(luma), 1e-9)
+
+	blurred := newLumaPlane(imaging.Blur(img, 3))
+	assert.True(t, luma.SSIM(blurred) < 0.9)
+}
+
+func TestBestFormat(t *testing.T) {
+	sanitize := func(img image.Image, format string) *SanitizeResult {
+		var in bytes.Buffer
+		switch format {
+		case "jpeg":
+			assert.NoError(t, jpeg.Encode(&in, img, &jpeg.Options{Quality: 95}))
+		case "png":
+			assert.NoError(t, png.Encode(&in, img))
+		}
+
+		opts := &SanitizeOptions{Format: "best", JPEGMode: "fixed", JPEGQuality: 80}
+		out, res, err := SanitizeImageFrom(bytes.NewReader(in.Bytes()), opts)
+		if !assert.NoError(t, err) {
+			return &SanitizeResult{}
+		}
+
+		_, format, err = image.Decode(out)
+		assert.NoError(t, err)
+		assert.Equal(t, res.Format, format)
+		return res
+	}
+
+	// A photo uploaded as PNG should come out as JPEG.
+	photo, err := imaging.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := sanitize(photo, "png")
+	assert.Equal(t, "png", res.SourceFormat)
+	assert.Equal(t, "jpeg", res.Format)
+
+	// A flat image uploaded as JPEG should come out as PNG.  Note that it
+	// has to be a lossless source, or JPEG artifacts add extra colors.
+	flat := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(flat, flat.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(flat, image.Rect(20, 20, 80, 80), image.Black, image.ZP, draw.Src)
+	res = sanitize(flat, "png")
+	assert.Equal(t, "png", res.Format)
+
+	// Photos with transparency have to stay PNG.
+	transparent := imaging.Clone(photo)
+	for i := 3; i < len(transparent.Pix); i += 4 {
+		transparent.Pix[i] = 0x80
+	}
+	res = sanitize(transparent, "png")
+	assert.Equal(t, "png", res.Format)
+}
+
+func TestConvertWithBackground(t *testing.T) {
+	// A transparent image, with an opaque black square in the middle.
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(img, image.Rect(16, 16, 48, 48), image.Black, image.ZP, draw.Src)
+
+	var in bytes.Buffer
+	assert.NoError(t, png.Encode(&in, img))
+
+	convert := func(bg *color.NRGBA) image.Image {
+		opts := &SanitizeOptions{Format: "jpeg", JPEGMode: "fixed", JPEGQuality: 90, Background: bg}
+		out, res, err := SanitizeImageFrom(bytes.NewReader(in.Bytes()), opts)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, "png", res.SourceFormat)
+		assert.Equal(t, "jpeg", res.Format)
+
+		decoded, err := jpeg.Decode(out)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return decoded
+	}
+
+	near := func(c color.Color, r, g, b uint8) bool {
+		cr, cg, cb, _ := c.RGBA()
+		return math.Abs(float64(cr>>8)-float64(r)) < 8 &&
+			math.Abs(float64(cg>>8)-float64(g)) < 8 &&
+			math.Abs(float64(cb>>8)-float64(b)) < 8
+	}
+
+	// Transparent areas default to white...
+	out := convert(nil)
+	assert.True(t, near(out.At(2, 2), 0xff, 0xff, 0xff))
+	assert.True(t, near(out.At(32, 32), 0, 0, 0))
+
+	// ... or take on the requested background.
+	out = convert(&color.NRGBA{0xff, 0, 0, 0xff})
+	assert.True(t, near(out.At(2, 2), 0xff, 0, 0))
+	assert.True(t, near(out.At(32, 32), 0, 0, 0))
+}
+
+func TestMaxSize(t *testing.T) {
+	sanitize := func(fname string, maxWidth, maxHeight int) (image.Image, *SanitizeResult) {
+		f, err := os.Open(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		opts := &SanitizeOptions{JPEGMode: "fixed", JPEGQuality: 90, MaxWidth: maxWidth, MaxHeight: maxHeight}
+		out, res, err := SanitizeImageFrom(f, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, _, err := image.Decode(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img, res
+	}
+
+	orig, err := imaging.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob := orig.Bounds()
+
+	// Images are scaled down to fit, keeping their aspect ratio.
+	img, res := sanitize("test.jpg", ob.Dx()/4, 0)
+	assert.True(t, res.Resized)
+	assert.Equal(t, ob.Dx()/4, img.Bounds().Dx())
+	assert.Equal(t, res.Width, img.Bounds().Dx())
+	assert.Equal(t, res.Height, img.Bounds().Dy())
+	assert.InDelta(t, float64(ob.Dx())/float64(ob.Dy()),
+		float64(img.Bounds().Dx())/float64(img.Bounds().Dy()), 0.05)
+
+	// ... but never up.
+	img, res = sanitize("test.jpg", ob.Dx()*2, ob.Dy()*2)
+	assert.False(t, res.Resized)
+	assert.Equal(t, ob, img.Bounds())
+
+	// The size limit applies to the image after it has been rotated.
+	img, res = sanitize(path.Join("exif-orientation-examples", "Landscape_6.jpg"), 30, 30)
+	assert.True(t, res.Resized)
+	assert.Equal(t, 30, img.Bounds().Dx())
+	assert.True(t, img.Bounds().Dx() > img.Bounds().Dy())
+}
@@ -0,0 +1,312 @@
+package main
+
+// This file contains the upload index: a record of every image we have
+// published, kept in a BoltDB database in the data directory.  Each upload is
+// stored as JSON under its ID.  The whole index is also kept in memory, since
+// looking for similar images has to go through all of it anyway.
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// uploadRecord is what the index knows about an upload.
+type uploadRecord struct {
+	// The upload's ID, and the key of its public image.
+	ID  string `json:"id"`
+	Key string `json:"key"`
+
+	// What the public image looks like.  Records from before these were
+	// kept have no format.
+	Format string `json:"format,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+
+	// Where the upload came from: the name it was uploaded with, its key in
+	// the archive bucket (if it was archived), and its format and size.
+	Filename       string `json:"filename,omitempty"`
+	ArchiveKey     string `json:"archive_key,omitempty"`
+	OriginalFormat string `json:"original_format,omitempty"`
+	OriginalSize   int64  `json:"original_size,omitempty"`
+
+	// Who uploaded it: the user they logged in as, their IP address, and
+	// the ID of the request.
+	Uploader  string `json:"uploader,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+
+	// The SHA-256 of the upload's deletion token, in hex (see
+	// newDeleteToken).
+	DeleteTokenHash string `json:"delete_token_sha256,omitempty"`
+
+	// The SHA-256 of the public image, in hex, and its perceptual hash
+	// (which is only 64 bits for older uploads; see dHash).
+	SHA256         string         `json:"sha256,omitempty"`
+	PerceptualHash perceptualHash `json:"perceptual_hash"`
+
+	Placeholder *Placeholder `json:"placeholder,omitempty"`
+
+	Renditions []renditionRecord `json:"renditions,omitempty"`
+
+	// When the upload was received, and when it was published.  Records
+	// from before the index was a database have no Received time.
+	Received time.Time `json:"received"`
+	Uploaded time.Time `json:"uploaded"`
+}
+
+type renditionRecord struct {
+	Name   string `json:"name"`
+	Key    string `json:"key"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// similarImage is an upload that looks like another one.
+type similarImage struct {
+	*uploadRecord
+	Distance int
+}
+
+type uploadIndex struct {
+	db *bolt.DB
+
+	mu        sync.RWMutex
+	records   []*uploadRecord
+	byID      map[string]*uploadRecord
+	byContent map[string]*uploadRecord
+
+	// Locks on the content of uploads that are being published (see
+	// LockContent).
+	locksMu sync.Mutex
+	locks   map[string]*contentLock
+}
+
+type contentLock struct {
+	sync.Mutex
+	refs int
+}
+
+var uploadsBucket = []byte("uploads")
+
+// Opens the index in a directory, creating it if it doesn't exist.
+func openUploadIndex(dir string) (*uploadIndex, error) {
+	path := filepath.Join(dir, "uploads.db")
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateIndex(db, dir); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	idx := &uploadIndex{
+		db:        db,
+		byID:      make(map[string]*uploadRecord),
+		byContent: make(map[string]*uploadRecord),
+		locks:     make(map[string]*contentLock),
+	}
+
+	var records []*uploadRecord
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).ForEach(func(k, v []byte) error {
+			rec := &uploadRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				log.WithFields(logrus.Fields{
+					"err":  err,
+					"path": path,
+					"id":   string(k),
+				}).Warn("skipping invalid record in upload index")
+				return nil
+			}
+			records = append(records, rec)
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// The database is ordered by ID, but the oldest upload of an image is
+	// the one that counts.
+	sort.Stable(byUploaded(records))
+	for _, rec := range records {
+		idx.insert(rec)
+	}
+
+	log.WithFields(logrus.Fields{
+		"path":    path,
+		"records": len(idx.records),
+	}).Info("loaded upload index")
+	return idx, nil
+}
+
+func (idx *uploadIndex) Close() error {
+	return idx.db.Close()
+}
+
+func (idx *uploadIndex) insert(rec *uploadRecord) {
+	idx.records = append(idx.records, rec)
+	idx.byID[rec.ID] = rec
+
+	// Only the first upload of an image is kept track of, since that's
+	// the one that duplicates are pointed at.
+	if len(rec.SHA256) > 0 && idx.byContent[rec.SHA256] == nil {
+		idx.byContent[rec.SHA256] = rec
+	}
+}
+
+// Adds a record to the index, and saves it to disk before returning.
+func (idx *uploadIndex) Add(rec *uploadRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	err = idx.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).Put([]byte(rec.ID), line)
+	})
+	if err != nil {
+		return err
+	}
+
+	idx.insert(rec)
+	return nil
+}
+
+// Removes the record for an ID from the index, if there is one.
+func (idx *uploadIndex) Delete(id string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	rec := idx.byID[id]
+	if rec == nil {
+		return nil
+	}
+	err := idx.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(idx.byID, id)
+	for i, r := range idx.records {
+		if r == rec {
+			idx.records = append(idx.records[:i], idx.records[i+1:]...)
+			break
+		}
+	}
+
+	// Later uploads of the same image now count as the first.
+	if len(rec.SHA256) > 0 && idx.byContent[rec.SHA256] == rec {
+		delete(idx.byContent, rec.SHA256)
+		for _, r := range idx.records {
+			if r.SHA256 == rec.SHA256 {
+				idx.byContent[rec.SHA256] = r
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the record for an ID, or nil if there isn't one.
+func (idx *uploadIndex) Get(id string) *uploadRecord {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.byID[id]
+}
+
+// Returns whether any other upload has the same archive key as rec.
+func (idx *uploadIndex) ArchiveShared(rec *uploadRecord) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	for _, r := range idx.records {
+		if r.ID != rec.ID && r.ArchiveKey == rec.ArchiveKey {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first upload with the given SHA-256, or nil if there isn't one.
+func (idx *uploadIndex) GetContent(sum string) *uploadRecord {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.byContent[sum]
+}
+
+// Locks the content with the given SHA-256, until the returned function is
+// called.  An upload holds the lock from before it looks for an earlier copy
+// of its image until it has been added to the index, so two uploads of the
+// same image at the same time can't both be published.
+func (idx *uploadIndex) LockContent(sum string) func() {
+	idx.locksMu.Lock()
+	l := idx.locks[sum]
+	if l == nil {
+		l = &contentLock{}
+		idx.locks[sum] = l
+	}
+	l.refs++
+	idx.locksMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		idx.locksMu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(idx.locks, sum)
+		}
+		idx.locksMu.Unlock()
+	}
+}
+
+// Returns the uploads whose perceptual hashes are within maxDistance of h,
+// closest (and then oldest) first.  The upload with the ID exclude, if any, is
+// left out, as are uploads whose hashes can't be compared with h.
+func (idx *uploadIndex) Similar(h perceptualHash, maxDistance int, exclude string) []similarImage {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var found []similarImage
+	for _, rec := range idx.records {
+		if rec.ID == exclude || !h.Comparable(rec.PerceptualHash) {
+			continue
+		}
+		if d := h.Distance(rec.PerceptualHash); d <= maxDistance {
+			found = append(found, similarImage{rec, d})
+		}
+	}
+
+	sort.Stable(byDistance(found))
+	return found
+}
+
+type byDistance []similarImage
+
+func (s byDistance) Len() int           { return len(s) }
+func (s byDistance) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDistance) Less(i, j int) bool { return s[i].Distance < s[j].Distance }
+
+type byUploaded []*uploadRecord
+
+func (s byUploaded) Len() int           { return len(s) }
+func (s byUploaded) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byUploaded) Less(i, j int) bool { return s[i].Uploaded.Before(s[j].Uploaded) }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestUploadIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagehost-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := openUploadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	records := []*uploadRecord{
+		{ID: "a", Key: "a.png", SHA256: "aaaa", PerceptualHash: perceptualHash{0x00ff}, Uploaded: now},
+		{ID: "b", Key: "b.png", SHA256: "bbbb", PerceptualHash: perceptualHash{0x0fff}, Uploaded: now.Add(time.Second)},
+		{ID: "c", Key: "c.jpeg", SHA256: "cccc", PerceptualHash: perceptualHash{0x00fe}, Uploaded: now.Add(2 * time.Second)},
+		{ID: "d", Key: "d.jpeg", SHA256: "aaaa", PerceptualHash: perceptualHash{0xff00}, Uploaded: now.Add(3 * time.Second)},
+	}
+	for _, rec := range records {
+		assert.NoError(t, idx.Add(rec))
+	}
+
+	assert.Equal(t, records[1], idx.Get("b"))
+	assert.Nil(t, idx.Get("e"))
+
+	// Duplicates are pointed at the first upload of an image.
+	assert.Equal(t, records[0], idx.GetContent("aaaa"))
+	assert.Equal(t, records[2], idx.GetContent("cccc"))
+	assert.Nil(t, idx.GetContent("eeee"))
+
+	ids := func(similar []similarImage) []string {
+		var out []string
+		for _, s := range similar {
+			out = append(out, s.ID)
+		}
+		return out
+	}
+
+	// Closest first, then oldest.
+	similar := idx.Similar(perceptualHash{0x00ff}, 4, "")
+	assert.Equal(t, []string{"a", "c", "b"}, ids(similar))
+	assert.Equal(t, []int{0, 1, 4}, []int{similar[0].Distance, similar[1].Distance, similar[2].Distance})
+	assert.Equal(t, []string{"c"}, ids(idx.Similar(perceptualHash{0x00ff}, 3, "a")))
+	assert.Empty(t, idx.Similar(perceptualHash{0xf0f0f0f0}, 4, ""))
+	idx.Close()
+
+	// The records are still there when the index is opened again, in the
+	// order they were uploaded.
+	idx, err = openUploadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, records, idx.records)
+	assert.Equal(t, records[0], idx.GetContent("aaaa"))
+
+	// Once the first upload of an image is deleted, the next one counts as
+	// the first.
+	assert.NoError(t, idx.Delete("a"))
+	assert.NoError(t, idx.Delete("e"))
+	assert.Nil(t, idx.Get("a"))
+	assert.Equal(t, records[3], idx.GetContent("aaaa"))
+	assert.Equal(t, []string{"c", "b"}, ids(idx.Similar(perceptualHash{0x00ff}, 4, "")))
+	idx.Close()
+
+	idx, err = openUploadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	assert.Equal(t, records[1:], idx.records)
+}
+
+func TestMigrateIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagehost-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The index from before it was a database, with a record longer than
+	// bufio.Scanner allows, a corrupt line that's far too long to be one,
+	// and a partly written last line.
+	legacy := `{"id":"a","key":"a.png","sha256":"aaaa","perceptual_hash":"00000000000000ff","uploaded":"2015-03-01T12:00:00Z"}
+{"id":"b","key":"b.png","sha256":"aaaa","perceptual_hash":"0000000000000fff","uploaded":"2015-03-01T12:00:01Z","padding":"` +
+		strings.Repeat("b", 100000) + `"}
+{"id":"d","padding":"` + strings.Repeat("d", maxLegacyRecord) + `"}
+{"id":"c","key":"c.pn`
+	legacyPath := filepath.Join(dir, "uploads.jsonl")
+	if err := ioutil.WriteFile(legacyPath, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := openUploadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, idx.records, 2)
+	assert.Equal(t, "a.png", idx.GetContent("aaaa").Key)
+	assert.Equal(t, perceptualHash{0x0fff}, idx.Get("b").PerceptualHash)
+	assert.Nil(t, idx.Get("c"))
+	assert.Nil(t, idx.Get("d"))
+	idx.Close()
+
+	// It's only imported once.
+	os.Remove(legacyPath)
+	idx, err = openUploadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, idx.records, 2)
+
+	// Databases from newer versions aren't touched.
+	err = idx.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(schemaVersion, []byte(strconv.Itoa(len(migrations)+1)))
+	})
+	assert.NoError(t, err)
+	idx.Close()
+	_, err = openUploadIndex(dir)
+	assert.Error(t, err)
+}
+
+func TestLockContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagehost-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := openUploadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	// Publish the same image from many uploads at once.  Only the first
+	// should find nothing there.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	published := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			unlock := idx.LockContent("aaaa")
+			defer unlock()
+			if idx.GetContent("aaaa") != nil {
+				return
+			}
+
+			// Give the others a chance to run.
+			time.Sleep(time.Millisecond)
+			idx.Add(&uploadRecord{ID: strconv.Itoa(i), SHA256: "aaaa"})
+
+			mu.Lock()
+			published++
+			mu.Unlock()
+		}(i)
+	}
+
+	// Other content isn't held up.
+	unlock := idx.LockContent("bbbb")
+	unlock()
+
+	wg.Wait()
+	assert.Equal(t, 1, published)
+	assert.Empty(t, idx.locks)
+}
@@ -0,0 +1,194 @@
+package main
+
+// This file contains the code that describes a published image, for the info
+// endpoint.  Uploads in the index are described from their record; anything
+// else (uploads from before there was an index, or when there isn't one) is
+// looked up in the public bucket instead.
+
+import (
+	"image"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+// The metadata header that the SHA-256 of an image is saved in.
+const sha256Header = "x-amz-meta-sha256"
+
+// imageInfo is what the info endpoint says about an image.
+type imageInfo struct {
+	ID        string `json:"id"`
+	PublicURL string `json:"public_url"`
+
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int64  `json:"size"`
+
+	// The SHA-256 of the public image, in hex, and its perceptual hash,
+	// which is only known for images in the index.  The SHA-256 of images
+	// uploaded before it was saved with them isn't known either, unless
+	// they are in the index.
+	SHA256         string          `json:"sha256"`
+	PerceptualHash *perceptualHash `json:"perceptual_hash,omitempty"`
+
+	Uploaded time.Time `json:"uploaded"`
+
+	Renditions  map[string]renditionInfo `json:"renditions"`
+	Placeholder *Placeholder             `json:"placeholder"`
+}
+
+type renditionInfo struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// Describes an upload from its record in the index.
+func infoFromRecord(b *s3.Bucket, rec *uploadRecord) *imageInfo {
+	phash := rec.PerceptualHash
+	info := &imageInfo{
+		ID:             rec.ID,
+		PublicURL:      b.URL(rec.Key),
+		Format:         rec.Format,
+		Width:          rec.Width,
+		Height:         rec.Height,
+		Size:           rec.Size,
+		SHA256:         rec.SHA256,
+		PerceptualHash: &phash,
+		Uploaded:       rec.Uploaded,
+		Renditions:     make(map[string]renditionInfo),
+		Placeholder:    rec.Placeholder,
+	}
+	for _, r := range rec.Renditions {
+		info.Renditions[r.Name] = renditionInfo{b.URL(r.Key), r.Width, r.Height}
+	}
+	return info
+}
+
+// Describes an image by looking at what's in the public bucket, returning
+// errImageNotFound if there is no image with that ID.  Only the start of each
+// object is read, which is enough to find its dimensions.
+func infoFromBucket(b *s3.Bucket, id string) (*imageInfo, error) {
+	if !imageIDRe.MatchString(id) {
+		return nil, errImageNotFound
+	}
+
+	main, renditions, err := listImageKeys(b, id)
+	if err != nil {
+		return nil, err
+	}
+	if main == nil {
+		return nil, errImageNotFound
+	}
+
+	info := &imageInfo{
+		ID:         id,
+		PublicURL:  b.URL(main.Key),
+		Size:       main.Size,
+		Renditions: make(map[string]renditionInfo),
+	}
+	if t, err := time.Parse(time.RFC3339, main.LastModified); err == nil {
+		info.Uploaded = t
+	}
+
+	config, format, header, err := imageHeader(b, main.Key)
+	if err != nil {
+		return nil, err
+	}
+	info.Format = format
+	info.Width, info.Height = config.Width, config.Height
+	info.SHA256 = header.Get(sha256Header)
+	info.Placeholder = placeholderFromHeaders(header)
+
+	for _, key := range renditions {
+		name := strings.TrimSuffix(key.Key[len(id)+1:], path.Ext(key.Key))
+		config, _, _, err := imageHeader(b, key.Key)
+		if err != nil {
+			return nil, err
+		}
+		info.Renditions[name] = renditionInfo{b.URL(key.Key), config.Width, config.Height}
+	}
+
+	return info, nil
+}
+
+// Finds the objects in the public bucket that make up the image with the
+// given ID: the image itself (which is nil if there isn't one), and its
+// renditions.
+func listImageKeys(b *s3.Bucket, id string) (*s3.Key, []s3.Key, error) {
+	// The image is saved as "ID.EXT", and its renditions as "ID-NAME.EXT".
+	// Other IDs can start with this one, so they have to be skipped.
+	list, err := b.List(id, "", "", 1000)
+	if err != nil {
+		return nil, nil, err
+	}
+	var main *s3.Key
+	var renditions []s3.Key
+	for i, key := range list.Contents {
+		switch rest := key.Key[len(id):]; {
+		case strings.HasPrefix(rest, "."):
+			main = &list.Contents[i]
+		case strings.HasPrefix(rest, "-"):
+			renditions = append(renditions, key)
+		}
+	}
+	return main, renditions, nil
+}
+
+// Returns the dimensions and format of an image in the bucket, and the headers
+// it was stored with.  Only the start of the image is read: closing the
+// response early stops the rest from being downloaded.
+func imageHeader(b *s3.Bucket, key string) (image.Config, string, http.Header, error) {
+	resp, err := b.GetResponse(key)
+	if err != nil {
+		return image.Config{}, "", nil, bucketError(err)
+	}
+	defer resp.Body.Close()
+
+	config, format, err := image.DecodeConfig(resp.Body)
+	return config, format, resp.Header, err
+}
+
+// Turns an S3 "not found" error into errImageNotFound.
+func bucketError(err error) error {
+	if serr, ok := err.(*s3.Error); ok && serr.StatusCode == http.StatusNotFound {
+		return errImageNotFound
+	}
+	return err
+}
+
+// Describes the upload with the given ID.
+func describeImage(b *s3.Bucket, index *uploadIndex, id string) (*imageInfo, error) {
+	var rec *uploadRecord
+	if index != nil {
+		rec = index.Get(id)
+	}
+	if rec == nil {
+		return infoFromBucket(b, id)
+	}
+
+	// Records from before the index kept track of the image's format don't
+	// say what it looks like, so fill that in from the bucket.
+	info := infoFromRecord(b, rec)
+	if len(rec.Format) == 0 {
+		stored, err := infoFromBucket(b, id)
+		if err != nil {
+			return nil, err
+		}
+		info.Format = stored.Format
+		info.Width, info.Height = stored.Width, stored.Height
+		info.Size = stored.Size
+		info.Renditions = stored.Renditions
+		if info.Placeholder == nil {
+			info.Placeholder = stored.Placeholder
+		}
+		if len(info.SHA256) == 0 {
+			info.SHA256 = stored.SHA256
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/mitchellh/goamz/s3/s3test"
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts a fake S3 server, and returns a bucket on it.
+func testBucket(t *testing.T) (*s3.Bucket, func()) {
+	srv, err := s3test.NewServer(&s3test.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := s3.New(aws.Auth{}, aws.Region{
+		Name:                 "faux-region-1",
+		S3Endpoint:           srv.URL(),
+		S3LocationConstraint: true,
+	})
+	b := client.Bucket("public")
+	if err := b.PutBucket(s3.PublicRead); err != nil {
+		srv.Quit()
+		t.Fatal(err)
+	}
+	return b, srv.Quit
+}
+
+func putPNG(t *testing.T, b *s3.Bucket, key string, w, h int, headers map[string][]string) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	if headers == nil {
+		headers = make(map[string][]string)
+	}
+	headers["Content-Type"] = []string{"image/png"}
+	if err := b.PutReaderHeader(key, bytes.NewReader(data), int64(len(data)), headers, s3.PublicRead); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestInfoFromBucket(t *testing.T) {
+	b, quit := testBucket(t)
+	defer quit()
+
+	placeholder := &Placeholder{
+		BlurHash:      "00TNoS",
+		LQIP:          "data:image/jpeg;base64,AAAA",
+		DominantColor: "#ff8000",
+		AverageColor:  "#ff8000",
+	}
+	headers := placeholder.Headers()
+	headers[sha256Header] = []string{"abcd"}
+	data := putPNG(t, b, "abc123.png", 40, 30, headers)
+	putPNG(t, b, "abc123-small.png", 20, 15, nil)
+	putPNG(t, b, "abc1234.png", 10, 10, nil)
+
+	info, err := infoFromBucket(b, "abc123")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "abc123", info.ID)
+	assert.Equal(t, b.URL("abc123.png"), info.PublicURL)
+	assert.Equal(t, "png", info.Format)
+	assert.Equal(t, 40, info.Width)
+	assert.Equal(t, 30, info.Height)
+	assert.Equal(t, int64(len(data)), info.Size)
+	assert.Equal(t, "abcd", info.SHA256)
+	assert.Nil(t, info.PerceptualHash)
+	assert.WithinDuration(t, time.Now(), info.Uploaded, time.Minute)
+	assert.Equal(t, placeholder, info.Placeholder)
+
+	// The other image whose ID starts with this one isn't a rendition.
+	assert.Equal(t, map[string]renditionInfo{
+		"small": {b.URL("abc123-small.png"), 20, 15},
+	}, info.Renditions)
+
+	for _, id := range []string{"abc12", "abc", "../abc123"} {
+		_, err = infoFromBucket(b, id)
+		assert.Equal(t, errImageNotFound, err, id)
+	}
+}
+
+func TestDescribeImage(t *testing.T) {
+	b, quit := testBucket(t)
+	defer quit()
+
+	dir, err := ioutil.TempDir("", "imagehost-info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := openUploadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	full := &uploadRecord{
+		ID:             "full",
+		Key:            "full.jpeg",
+		Format:         "jpeg",
+		Width:          800,
+		Height:         600,
+		Size:           12345,
+		SHA256:         "aaaa",
+		PerceptualHash: perceptualHash{0x1234},
+		Renditions:     []renditionRecord{{"thumb", "full-thumb.jpeg", 100, 75}},
+		Uploaded:       now,
+	}
+	old := &uploadRecord{ID: "old", Key: "old.png", SHA256: "bbbb", PerceptualHash: perceptualHash{0x5678}, Uploaded: now}
+	assert.NoError(t, idx.Add(full))
+	assert.NoError(t, idx.Add(old))
+	putPNG(t, b, "old.png", 40, 30, nil)
+	putPNG(t, b, "other.png", 20, 20, nil)
+
+	// Everything about a record is known without looking at the bucket.
+	info, err := describeImage(b, idx, "full")
+	if assert.NoError(t, err) {
+		phash := perceptualHash{0x1234}
+		assert.Equal(t, &imageInfo{
+			ID:             "full",
+			PublicURL:      b.URL("full.jpeg"),
+			Format:         "jpeg",
+			Width:          800,
+			Height:         600,
+			Size:           12345,
+			SHA256:         "aaaa",
+			PerceptualHash: &phash,
+			Uploaded:       now,
+			Renditions: map[string]renditionInfo{
+				"thumb": {b.URL("full-thumb.jpeg"), 100, 75},
+			},
+		}, info)
+	}
+
+	// Older records are filled in from the bucket.
+	info, err = describeImage(b, idx, "old")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "png", info.Format)
+		assert.Equal(t, 40, info.Width)
+		assert.Equal(t, "bbbb", info.SHA256)
+		assert.Equal(t, now, info.Uploaded)
+		assert.Equal(t, perceptualHash{0x5678}, *info.PerceptualHash)
+	}
+
+	// Images that aren't in the index are found in the bucket.
+	info, err = describeImage(b, idx, "other")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 20, info.Height)
+	}
+	_, err = describeImage(b, nil, "missing")
+	assert.Equal(t, errImageNotFound, err)
+}
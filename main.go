@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -20,10 +21,46 @@ import (
 )
 
 type Config struct {
-	PublicBucket    string `yaml:"public_bucket"`
-	ArchiveBucket   string `yaml:"archive_bucket"`
-	JPEGCompression int    `yaml:"jpeg_compression"`
-	BaseURL         string `yaml:"base_url"`
+	PublicBucket    string  `yaml:"public_bucket"`
+	ArchiveBucket   string  `yaml:"archive_bucket"`
+	JPEGCompression int     `yaml:"jpeg_compression"`
+	JPEGMode        string  `yaml:"jpeg_mode"`
+	JPEGMinQuality  int     `yaml:"jpeg_min_quality"`
+	JPEGMaxQuality  int     `yaml:"jpeg_max_quality"`
+	JPEGMaxBytes    int64   `yaml:"jpeg_max_bytes"`
+	JPEGMinSSIM     float64 `yaml:"jpeg_min_ssim"`
+	OutputFormat    string  `yaml:"output_format"`
+	AcceptTIFF      bool    `yaml:"accept_tiff"`
+	GIFDither       bool    `yaml:"gif_dither"`
+	MaxWidth        int     `yaml:"max_width"`
+	MaxHeight       int     `yaml:"max_height"`
+	SmartCropSkin   bool    `yaml:"smart_crop_skin"`
+	AntiFingerprint bool    `yaml:"anti_fingerprint"`
+	BaseURL         string  `yaml:"base_url"`
+
+	Renditions map[string]string `yaml:"renditions"`
+	renditions []RenditionSpec
+
+	StreamingUploads bool `yaml:"streaming_uploads"`
+
+	ProcessingMemoryMB    int `yaml:"processing_memory_mb"`
+	ProcessingWaitSeconds int `yaml:"processing_wait_seconds"`
+
+	Sandbox SandboxConfig `yaml:"sandbox"`
+
+	RequestOptions RequestOptionsConfig `yaml:"request_options"`
+
+	Transforms TransformConfig `yaml:"transforms"`
+
+	Faces FaceConfig `yaml:"faces"`
+
+	Watermark WatermarkConfig `yaml:"watermark"`
+
+	DataDir string `yaml:"data_dir"`
+
+	ContentAddressedKeys bool `yaml:"content_addressed_keys"`
+
+	Duplicates DuplicateConfig `yaml:"duplicates"`
 
 	AWSAuth struct {
 		AccessKey string `yaml:"access_key"`
@@ -38,6 +75,71 @@ type Config struct {
 	} `yaml:"auth"`
 }
 
+type SandboxConfig struct {
+	Enabled        bool `yaml:"enabled"`
+	MemoryMB       int  `yaml:"memory_mb"`
+	CPUSeconds     int  `yaml:"cpu_seconds"`
+	TimeoutSeconds int  `yaml:"timeout_seconds"`
+}
+
+// Which encoding options clients may set on their uploads.
+type RequestOptionsConfig struct {
+	Formats    []string `yaml:"formats"`
+	Quality    bool     `yaml:"quality"`
+	Background bool     `yaml:"background"`
+	MaxSize    bool     `yaml:"max_size"`
+	Crop       bool     `yaml:"crop"`
+	Redact     bool     `yaml:"redact"`
+
+	AntiFingerprint bool `yaml:"anti_fingerprint"`
+	Watermark       bool `yaml:"watermark"`
+	Duplicates      bool `yaml:"duplicates"`
+}
+
+type TransformConfig struct {
+	Secret       string `yaml:"secret"`
+	MaxWidth     int    `yaml:"max_width"`
+	MaxHeight    int    `yaml:"max_height"`
+	CacheMB      int    `yaml:"cache_mb"`
+	CacheDir     string `yaml:"cache_dir"`
+	CacheDiskMB  int    `yaml:"cache_disk_mb"`
+	CacheSeconds int    `yaml:"cache_seconds"`
+}
+
+type FaceConfig struct {
+	Cascade     string  `yaml:"cascade"`
+	MinSize     int     `yaml:"min_size"`
+	MaxSize     int     `yaml:"max_size"`
+	ShiftFactor float64 `yaml:"shift_factor"`
+	ScaleFactor float64 `yaml:"scale_factor"`
+	Threshold   float64 `yaml:"threshold"`
+}
+
+type DuplicateConfig struct {
+	Action      string `yaml:"action"`
+	MaxDistance int    `yaml:"max_distance"`
+}
+
+type WatermarkConfig struct {
+	Enabled    bool    `yaml:"enabled"`
+	Text       string  `yaml:"text"`
+	Logo       string  `yaml:"logo"`
+	Color      string  `yaml:"color"`
+	Position   string  `yaml:"position"`
+	Opacity    float64 `yaml:"opacity"`
+	Scale      float64 `yaml:"scale"`
+	Margin     float64 `yaml:"margin"`
+	Renditions bool    `yaml:"renditions"`
+
+	// The options above, if a watermark is configured.
+	options *WatermarkOptions
+}
+
+// Returns how long a sandboxed sanitizer may run for.
+func (c *SandboxConfig) Timeout() time.Duration {
+	return time.Duration(c.TimeoutSeconds) * time.Second
+}
+
 var (
 	flagConfigFile string
 	flagPort       int
@@ -80,6 +182,137 @@ func validateConfig(config *Config) error {
 	if config.JPEGCompression == 0 {
 		config.JPEGCompression = 80
 	}
+	switch config.JPEGMode {
+	case "":
+		config.JPEGMode = "preserve"
+	case "preserve", "fixed":
+	case "max_size":
+		if config.JPEGMaxBytes <= 0 {
+			return fmt.Errorf("JPEG mode 'max_size' requires jpeg_max_bytes")
+		}
+	case "min_ssim":
+		if config.JPEGMinSSIM <= 0 || config.JPEGMinSSIM > 1 {
+			return fmt.Errorf("JPEG mode 'min_ssim' requires jpeg_min_ssim between 0 and 1")
+		}
+	default:
+		return fmt.Errorf("Unknown JPEG mode '%s'", config.JPEGMode)
+	}
+	if config.JPEGMinQuality == 0 {
+		config.JPEGMinQuality = 60
+	}
+	if config.JPEGMaxQuality == 0 {
+		config.JPEGMaxQuality = 90
+	}
+	if config.JPEGMinQuality < 1 || config.JPEGMaxQuality > 100 ||
+		config.JPEGMinQuality > config.JPEGMaxQuality {
+		return fmt.Errorf("JPEG quality range %d-%d is not valid",
+			config.JPEGMinQuality, config.JPEGMaxQuality)
+	}
+	if config.ProcessingMemoryMB < 0 {
+		return fmt.Errorf("Processing memory budget cannot be negative")
+	}
+	if config.ProcessingWaitSeconds <= 0 {
+		config.ProcessingWaitSeconds = 30
+	}
+	if config.Sandbox.MemoryMB == 0 {
+		config.Sandbox.MemoryMB = 1024
+	}
+	if config.Sandbox.CPUSeconds == 0 {
+		config.Sandbox.CPUSeconds = 30
+	}
+	if config.Sandbox.TimeoutSeconds == 0 {
+		config.Sandbox.TimeoutSeconds = 60
+	}
+	switch config.OutputFormat {
+	case "", "same":
+		config.OutputFormat = ""
+	case "best":
+	default:
+		return fmt.Errorf("Unknown output format '%s'", config.OutputFormat)
+	}
+	if config.MaxWidth < 0 || config.MaxHeight < 0 {
+		return fmt.Errorf("Maximum image size cannot be negative")
+	}
+	renditions, err := parseRenditions(config.Renditions)
+	if err != nil {
+		return err
+	}
+	config.renditions = renditions
+	for _, f := range config.RequestOptions.Formats {
+		switch f {
+		case "gif", "jpeg", "png", "best":
+		default:
+			return fmt.Errorf("Unknown request format '%s'", f)
+		}
+	}
+	if err := validateTransformSecret(config.Transforms.Secret); err != nil {
+		return err
+	}
+	if config.Transforms.MaxWidth <= 0 {
+		config.Transforms.MaxWidth = 4096
+	}
+	if config.Transforms.MaxHeight <= 0 {
+		config.Transforms.MaxHeight = 4096
+	}
+	if config.Transforms.CacheMB <= 0 {
+		config.Transforms.CacheMB = 64
+	}
+	if config.Transforms.CacheDiskMB <= 0 {
+		config.Transforms.CacheDiskMB = 1024
+	}
+	if config.Transforms.CacheSeconds <= 0 {
+		config.Transforms.CacheSeconds = 365 * 24 * 60 * 60
+	}
+	if len(config.Faces.Cascade) > 0 {
+		// The sandbox runs in another directory, so a relative path would
+		// be looked up in the wrong place.
+		path, err := filepath.Abs(config.Faces.Cascade)
+		if err != nil {
+			return fmt.Errorf("Error loading face cascade: %s", err)
+		}
+		config.Faces.Cascade = path
+		if _, err := loadCascade(config.Faces.Cascade); err != nil {
+			return fmt.Errorf("Error loading face cascade: %s", err)
+		}
+	}
+	if config.Faces.MinSize <= 0 {
+		config.Faces.MinSize = 20
+	}
+	if config.Faces.MaxSize <= 0 {
+		config.Faces.MaxSize = 1000
+	}
+	if config.Faces.ShiftFactor <= 0 {
+		config.Faces.ShiftFactor = 0.1
+	}
+	if config.Faces.ScaleFactor <= 1 {
+		config.Faces.ScaleFactor = 1.1
+	}
+	if config.Faces.Threshold == 0 {
+		config.Faces.Threshold = 5
+	}
+	if err := validateWatermark(&config.Watermark); err != nil {
+		return err
+	}
+	if config.ContentAddressedKeys && len(config.DataDir) == 0 {
+		return fmt.Errorf("Content-addressed keys require data_dir")
+	}
+	switch config.Duplicates.Action {
+	case "":
+		config.Duplicates.Action = "allow"
+	case "allow":
+	case "reject", "link":
+		if len(config.DataDir) == 0 {
+			return fmt.Errorf("Duplicate action '%s' requires data_dir", config.Duplicates.Action)
+		}
+	default:
+		return fmt.Errorf("Duplicate action '%s' not valid", config.Duplicates.Action)
+	}
+	if config.Duplicates.MaxDistance <= 0 {
+		config.Duplicates.MaxDistance = 80
+	}
+	if config.Duplicates.MaxDistance > perceptualHashBits {
+		return fmt.Errorf("Duplicate max_distance must be at most %d", perceptualHashBits)
+	}
 	if len(config.BaseURL) == 0 {
 		config.BaseURL = "/"
 	}
@@ -98,7 +331,112 @@ func validateConfig(config *Config) error {
 	return nil
 }
 
+// Transform secrets must be at least this long.
+const minTransformSecret = 16
+
+// Secrets that show up in examples, which must never be used.
+var placeholderSecrets = []string{"changeme", "change-me", "secret", "password", "example", "xxxxxxxx"}
+
+func validateTransformSecret(secret string) error {
+	if len(secret) == 0 {
+		return nil
+	}
+	lower := strings.ToLower(secret)
+	for _, p := range placeholderSecrets {
+		if strings.Contains(lower, p) {
+			return fmt.Errorf("Transform secret looks like a placeholder; generate a random one")
+		}
+	}
+	if len(secret) < minTransformSecret {
+		return fmt.Errorf("Transform secret must be at least %d characters", minTransformSecret)
+	}
+	return nil
+}
+
+// The longest text watermark, in characters.
+const maxWatermarkText = 100
+
+func validateWatermark(config *WatermarkConfig) error {
+	if len(config.Text) == 0 && len(config.Logo) == 0 {
+		if config.Enabled {
+			return fmt.Errorf("Watermark is enabled, but has no text or logo")
+		}
+		return nil
+	}
+	if len(config.Text) > 0 && len(config.Logo) > 0 {
+		return fmt.Errorf("Watermark can't have both text and a logo")
+	}
+	if len([]rune(config.Text)) > maxWatermarkText {
+		return fmt.Errorf("Watermark text is longer than %d characters", maxWatermarkText)
+	}
+	if len(config.Logo) > 0 {
+		// As with the face cascade, the sandbox needs an absolute path.
+		path, err := filepath.Abs(config.Logo)
+		if err != nil {
+			return fmt.Errorf("Error loading watermark logo: %s", err)
+		}
+		config.Logo = path
+		if _, err := loadLogo(config.Logo); err != nil {
+			return fmt.Errorf("Error loading watermark logo: %s", err)
+		}
+	}
+
+	if len(config.Color) == 0 {
+		config.Color = "#ffffff"
+	}
+	c, err := parseHexColor(config.Color)
+	if err != nil {
+		return fmt.Errorf("Watermark color %s", err)
+	}
+	if len(config.Position) == 0 {
+		config.Position = "bottom-right"
+	}
+	if !watermarkPositions[config.Position] {
+		return fmt.Errorf("Watermark position '%s' not valid", config.Position)
+	}
+	if config.Opacity == 0 {
+		config.Opacity = 0.5
+	}
+	if config.Opacity < 0 || config.Opacity > 1 {
+		return fmt.Errorf("Watermark opacity must be between 0 and 1")
+	}
+	if config.Scale == 0 {
+		config.Scale = 0.2
+	}
+	if config.Scale < 0 || config.Scale > 1 {
+		return fmt.Errorf("Watermark scale must be between 0 and 1")
+	}
+	if config.Margin == 0 {
+		config.Margin = 0.02
+	}
+	if config.Margin < 0 || config.Margin > 0.5 {
+		return fmt.Errorf("Watermark margin must be between 0 and 0.5")
+	}
+
+	config.options = &WatermarkOptions{
+		Text:       config.Text,
+		Logo:       config.Logo,
+		Color:      c,
+		Position:   config.Position,
+		Opacity:    config.Opacity,
+		Scale:      config.Scale,
+		Margin:     config.Margin,
+		Renditions: config.Renditions,
+	}
+	return nil
+}
+
+// Returns how long an upload may wait for the processing budget.
+func (c *Config) ProcessingWait() time.Duration {
+	return time.Duration(c.ProcessingWaitSeconds) * time.Second
+}
+
 func main() {
+	// If we were started to sanitize a single image, do that and nothing else.
+	if isSandboxChild() {
+		os.Exit(runSandboxChild())
+	}
+
 	flag.Parse()
 
 	var config Config
@@ -129,6 +467,40 @@ func main() {
 	}
 	client := s3.New(auth, aws.Regions[config.AWSAuth.Region])
 
+	// Limit how much memory image processing can use at once.
+	budget := newMemoryBudget(int64(config.ProcessingMemoryMB) * 1024 * 1024)
+
+	// Transformed images are cached, so they don't need to be made again.
+	var cache derivativeCache = newMemoryCache(int64(config.Transforms.CacheMB) * 1024 * 1024)
+	if len(config.Transforms.CacheDir) > 0 {
+		cache, err = newDiskCache(config.Transforms.CacheDir,
+			int64(config.Transforms.CacheDiskMB)*1024*1024)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err":       err,
+				"cache_dir": config.Transforms.CacheDir,
+			}).Error("Error opening cache")
+			return
+		}
+	}
+	cache = &countingCache{derivativeCache: cache}
+
+	// Keep track of what's been uploaded, if there's somewhere to do it.
+	var index *uploadIndex
+	if len(config.DataDir) > 0 {
+		if err = os.MkdirAll(config.DataDir, 0700); err == nil {
+			index, err = openUploadIndex(config.DataDir)
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err":      err,
+				"data_dir": config.DataDir,
+			}).Error("Error opening upload index")
+			return
+		}
+		defer index.Close()
+	}
+
 	// Authorization
 	authOpts := httpauth.AuthOptions{
 		Realm:    "ImageHost",
@@ -142,11 +514,15 @@ func main() {
 	m.Use(recoverMiddleware)
 	m.Use(middleware.AutomaticOptions)
 
-	// Inject our config and S3 instance into each request.
+	// Inject our config, S3 instance, processing budget, cache and upload
+	// index into each request.
 	m.Use(func(c *web.C, h http.Handler) http.Handler {
 		ret := func(w http.ResponseWriter, r *http.Request) {
 			c.Env["client"] = client
 			c.Env["config"] = &config
+			c.Env["budget"] = budget
+			c.Env["cache"] = cache
+			c.Env["index"] = index
 
 			h.ServeHTTP(w, r)
 		}
@@ -155,6 +531,13 @@ func main() {
 
 	// Set up actual routes.
 	m.Get("/", Index)
+	m.Get("/info/:id", Info)
+	m.Delete("/images/:id", DeleteImage)
+
+	// Transformations are only available if there's a secret to sign them.
+	if len(config.Transforms.Secret) > 0 {
+		m.Get("/img/:id/:transform", ServeTransform)
+	}
 
 	// Static assets
 	for _, asset := range AssetDescriptors() {
@@ -168,6 +551,12 @@ func main() {
 	authorized := web.New()
 	authorized.Use(httpauth.BasicAuth(authOpts))
 	authorized.Post("/upload", Upload)
+	if len(config.Transforms.Secret) > 0 {
+		authorized.Get("/sign/:id/:transform", SignTransform)
+	}
+	if index != nil {
+		authorized.Get("/similar/:id", Similar)
+	}
 	m.Handle("/*", authorized)
 
 	// Good to go!
@@ -0,0 +1,165 @@
+package main
+
+// This file contains the migrations that bring the upload index's database up
+// to date.  The database records how many of them have been applied, and any
+// that haven't are run, in order, when it is opened.  Each one runs in its own
+// transaction, so a failed migration leaves the database as the previous one
+// left it.  Migrations must never be changed or reordered once released - add
+// a new one instead.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+type migration struct {
+	name string
+	run  func(tx *bolt.Tx, dir string) error
+}
+
+var migrations = []migration{
+	{"create uploads bucket", createUploadsBucket},
+	{"import uploads.jsonl", importLegacyIndex},
+}
+
+var (
+	metaBucket    = []byte("meta")
+	schemaVersion = []byte("schema_version")
+)
+
+// Applies any migrations that the database in dir hasn't had yet.
+func migrateIndex(db *bolt.DB, dir string) error {
+	var version int
+	err := db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if v := meta.Get(schemaVersion); v != nil {
+			version, err = strconv.Atoi(string(v))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("upload index has schema version %d, but this version of imagehost only knows %d",
+			version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		m := migrations[version]
+		err := db.Update(func(tx *bolt.Tx) error {
+			if err := m.run(tx, dir); err != nil {
+				return err
+			}
+			return tx.Bucket(metaBucket).Put(schemaVersion, []byte(strconv.Itoa(version+1)))
+		})
+		if err != nil {
+			return fmt.Errorf("error migrating upload index (%s): %s", m.name, err)
+		}
+
+		log.WithFields(logrus.Fields{
+			"version":   version + 1,
+			"migration": m.name,
+		}).Info("migrated upload index")
+	}
+	return nil
+}
+
+func createUploadsBucket(tx *bolt.Tx, dir string) error {
+	_, err := tx.CreateBucketIfNotExists(uploadsBucket)
+	return err
+}
+
+// The longest line of the legacy index that is read as a record.  Real
+// records are a few hundred bytes, so anything this long is corrupt.
+const maxLegacyRecord = 1 << 20
+
+// Imports the index from before it was a database: a file with one record, as
+// JSON, on each line.  A crash could leave a partial line at the end, so
+// lines that can't be read (or are far too long to be records) are skipped.
+// The file itself is left alone.
+func importLegacyIndex(tx *bolt.Tx, dir string) error {
+	path := filepath.Join(dir, "uploads.jsonl")
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b := tx.Bucket(uploadsBucket)
+	r := bufio.NewReader(f)
+	line, imported := 0, 0
+	for {
+		data, tooLong, err := readLegacyLine(r)
+		if err == io.EOF && len(data) == 0 && !tooLong {
+			break
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		line++
+
+		if tooLong {
+			log.WithFields(logrus.Fields{
+				"path": path,
+				"line": line,
+			}).Warn("skipping overlong line in legacy upload index")
+			continue
+		}
+
+		rec := &uploadRecord{}
+		if err := json.Unmarshal(data, rec); err != nil || len(rec.ID) == 0 {
+			log.WithFields(logrus.Fields{
+				"err":  err,
+				"path": path,
+				"line": line,
+			}).Warn("skipping invalid record in legacy upload index")
+			continue
+		}
+
+		data, err = json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(rec.ID), data); err != nil {
+			return err
+		}
+		imported++
+	}
+
+	log.WithFields(logrus.Fields{
+		"path":    path,
+		"records": imported,
+	}).Info("imported legacy upload index; the file is no longer used")
+	return nil
+}
+
+// Reads a line of the legacy index.  Lines longer than maxLegacyRecord are
+// read to the end but not kept, and reported as too long instead.
+func readLegacyLine(r *bufio.Reader) (line []byte, tooLong bool, err error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > maxLegacyRecord {
+				line, tooLong = nil, true
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err != bufio.ErrBufferFull {
+			return line, tooLong, err
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+// This file contains the code that works out how to sanitize an upload, from
+// the configuration and whatever options the client sent with it.
+
+import (
+	"fmt"
+	"image/color"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Builds the SanitizeOptions for an upload.  Clients may override some of
+// the defaults with form fields or query parameters, as long as the
+// configuration allows it:
+//
+//	format     - the format to convert the image to
+//	quality    - the JPEG quality to use
+//	background - the color to flatten transparent images onto when
+//	             converting them to JPEG, as "#rrggbb"
+//	max_width  - the largest width and height the image may be published at;
+//	max_height   these can only be smaller than the configured limits
+//	aspect     - crop the image to this aspect ratio, as "W:H"
+//	crop       - how to crop the image and any "fill" renditions: "center"
+//	             or "smart"
+//	redact     - a region to redact, as "X,Y,WIDTH,HEIGHT,MODE"; may be
+//	             given more than once
+//	redact_faces - if "true", find faces and pixelate them
+//	anti_fingerprint - if "true", suppress the camera's sensor fingerprint
+//	watermark  - "true" or "false", to turn the configured watermark on or off
+func sanitizeOptions(r *http.Request, config *Config) (*SanitizeOptions, error) {
+	opts := &SanitizeOptions{
+		Format:          config.OutputFormat,
+		JPEGMode:        config.JPEGMode,
+		JPEGQuality:     config.JPEGCompression,
+		MinJPEGQuality:  config.JPEGMinQuality,
+		MaxJPEGQuality:  config.JPEGMaxQuality,
+		JPEGMaxBytes:    config.JPEGMaxBytes,
+		JPEGMinSSIM:     config.JPEGMinSSIM,
+		GIFDither:       config.GIFDither,
+		MaxWidth:        config.MaxWidth,
+		MaxHeight:       config.MaxHeight,
+		Renditions:      config.renditions,
+		SmartCropSkin:   config.SmartCropSkin,
+		AntiFingerprint: config.AntiFingerprint,
+	}
+	if config.Watermark.Enabled {
+		opts.Watermark = config.Watermark.options
+	}
+	allowed := &config.RequestOptions
+
+	if format := r.FormValue("format"); len(format) > 0 {
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		if !allowed.allowsFormat(format) {
+			return nil, fmt.Errorf("format '%s' is not allowed", format)
+		}
+		opts.Format = format
+	}
+
+	if quality := r.FormValue("quality"); len(quality) > 0 {
+		if !allowed.Quality {
+			return nil, fmt.Errorf("setting the quality is not allowed")
+		}
+
+		q, err := strconv.Atoi(quality)
+		if err != nil || q < config.JPEGMinQuality || q > config.JPEGMaxQuality {
+			return nil, fmt.Errorf("quality must be a number from %d to %d",
+				config.JPEGMinQuality, config.JPEGMaxQuality)
+		}
+		opts.JPEGMode = "fixed"
+		opts.JPEGQuality = q
+	}
+
+	if background := r.FormValue("background"); len(background) > 0 {
+		if !allowed.Background {
+			return nil, fmt.Errorf("setting the background is not allowed")
+		}
+
+		c, err := parseHexColor(background)
+		if err != nil {
+			return nil, err
+		}
+		opts.Background = &c
+	}
+
+	for _, dim := range []struct {
+		name string
+		max  *int
+	}{
+		{"max_width", &opts.MaxWidth},
+		{"max_height", &opts.MaxHeight},
+	} {
+		value := r.FormValue(dim.name)
+		if len(value) == 0 {
+			continue
+		}
+		if !allowed.MaxSize {
+			return nil, fmt.Errorf("setting %s is not allowed", dim.name)
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%s must be a positive number", dim.name)
+		}
+		if *dim.max > 0 && n > *dim.max {
+			return nil, fmt.Errorf("%s cannot be larger than %d", dim.name, *dim.max)
+		}
+		*dim.max = n
+	}
+
+	if aspect := r.FormValue("aspect"); len(aspect) > 0 {
+		if !allowed.Crop {
+			return nil, fmt.Errorf("setting the aspect ratio is not allowed")
+		}
+
+		m := aspectRe.FindStringSubmatch(aspect)
+		if m == nil {
+			return nil, fmt.Errorf("aspect must look like 'W:H'")
+		}
+		opts.AspectWidth, _ = strconv.Atoi(m[1])
+		opts.AspectHeight, _ = strconv.Atoi(m[2])
+		if opts.AspectWidth < 1 || opts.AspectHeight < 1 {
+			return nil, fmt.Errorf("aspect must look like 'W:H'")
+		}
+		opts.Crop = "center"
+	}
+
+	if crop := r.FormValue("crop"); len(crop) > 0 {
+		if !allowed.Crop {
+			return nil, fmt.Errorf("setting the crop is not allowed")
+		}
+		if crop != "center" && crop != "smart" {
+			return nil, fmt.Errorf("crop must be 'center' or 'smart'")
+		}
+		opts.Crop = crop
+
+		// Copy the renditions, since they're shared with the config.
+		renditions := make([]RenditionSpec, len(opts.Renditions))
+		for i, spec := range opts.Renditions {
+			if spec.Mode == "fill" {
+				spec.Crop = crop
+			}
+			renditions[i] = spec
+		}
+		opts.Renditions = renditions
+	}
+
+	if redactions := r.Form["redact"]; len(redactions) > 0 {
+		if !allowed.Redact {
+			return nil, fmt.Errorf("redacting is not allowed")
+		}
+		if len(redactions) > maxRedactions {
+			return nil, fmt.Errorf("no more than %d regions can be redacted", maxRedactions)
+		}
+
+		for _, s := range redactions {
+			red, err := parseRedaction(s)
+			if err != nil {
+				return nil, err
+			}
+			opts.Redactions = append(opts.Redactions, red)
+		}
+	}
+
+	if redactFaces := r.FormValue("redact_faces"); len(redactFaces) > 0 {
+		enabled, err := strconv.ParseBool(redactFaces)
+		if err != nil {
+			return nil, fmt.Errorf("redact_faces must be 'true' or 'false'")
+		}
+		if enabled {
+			if !allowed.Redact || len(config.Faces.Cascade) == 0 {
+				return nil, fmt.Errorf("redacting faces is not allowed")
+			}
+			opts.Faces = &FaceOptions{
+				Cascade:     config.Faces.Cascade,
+				MinSize:     config.Faces.MinSize,
+				MaxSize:     config.Faces.MaxSize,
+				ShiftFactor: config.Faces.ShiftFactor,
+				ScaleFactor: config.Faces.ScaleFactor,
+				Threshold:   config.Faces.Threshold,
+			}
+		}
+	}
+
+	if antiFingerprint := r.FormValue("anti_fingerprint"); len(antiFingerprint) > 0 {
+		enabled, err := strconv.ParseBool(antiFingerprint)
+		if err != nil {
+			return nil, fmt.Errorf("anti_fingerprint must be 'true' or 'false'")
+		}
+
+		// If it's on for every upload, clients can't turn it off.
+		if enabled != opts.AntiFingerprint {
+			if !allowed.AntiFingerprint || !enabled {
+				return nil, fmt.Errorf("changing anti_fingerprint is not allowed")
+			}
+			opts.AntiFingerprint = true
+		}
+	}
+
+	if watermark := r.FormValue("watermark"); len(watermark) > 0 {
+		enabled, err := strconv.ParseBool(watermark)
+		if err != nil {
+			return nil, fmt.Errorf("watermark must be 'true' or 'false'")
+		}
+		if !allowed.Watermark || config.Watermark.options == nil {
+			return nil, fmt.Errorf("changing the watermark is not allowed")
+		}
+
+		opts.Watermark = nil
+		if enabled {
+			opts.Watermark = config.Watermark.options
+		}
+	}
+
+	return opts, nil
+}
+
+// Returns what to do if an upload turns out to be a near-duplicate of an
+// earlier one: "allow" it, "reject" it, or "link" to the earlier one instead.
+// Clients may choose with the "duplicates" field, if the configuration allows
+// it.
+func duplicateAction(r *http.Request, config *Config) (string, error) {
+	action := r.FormValue("duplicates")
+	if len(action) == 0 {
+		return config.Duplicates.Action, nil
+	}
+
+	if !config.RequestOptions.Duplicates || len(config.DataDir) == 0 {
+		return "", fmt.Errorf("choosing what to do with duplicates is not allowed")
+	}
+	switch action {
+	case "allow", "reject", "link":
+		return action, nil
+	}
+	return "", fmt.Errorf("duplicates must be 'allow', 'reject' or 'link'")
+}
+
+// Returns whether the options hide part of the image (or where it came from),
+// or watermark it.  An earlier upload of the same image may not have had that
+// done to it, so such uploads are never swapped for one.
+func (opts *SanitizeOptions) hidesContent() bool {
+	return len(opts.Redactions) > 0 || opts.Faces != nil || opts.AntiFingerprint || opts.Watermark != nil
+}
+
+// The most regions that can be redacted in one upload.
+const maxRedactions = 100
+
+var aspectRe = regexp.MustCompile(`^(\d+):(\d+)$`)
+
+func (c *RequestOptionsConfig) allowsFormat(format string) bool {
+	for _, f := range c.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses a color given as "#rrggbb" or "#rgb" (the "#" is optional).
+func parseHexColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 {
+		return color.NRGBA{}, fmt.Errorf("'%s' is not a valid color", s)
+	}
+
+	return color.NRGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, nil
+}
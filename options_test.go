@@ -0,0 +1,205 @@
+package main
+
+import (
+	"image/color"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeOptions(t *testing.T) {
+	config := &Config{
+		JPEGMode:        "preserve",
+		JPEGCompression: 80,
+		JPEGMinQuality:  60,
+		JPEGMaxQuality:  90,
+		MaxWidth:        1000,
+		RequestOptions: RequestOptionsConfig{
+			Formats:    []string{"jpeg", "png"},
+			Quality:    true,
+			Background: true,
+			MaxSize:    true,
+			Crop:       true,
+			Redact:     true,
+
+			AntiFingerprint: true,
+			Watermark:       true,
+			Duplicates:      true,
+		},
+	}
+
+	parse := func(query string) (*SanitizeOptions, error) {
+		r, err := http.NewRequest("POST", "/upload?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sanitizeOptions(r, config)
+	}
+
+	// Without any options, the configured defaults are used.
+	opts, err := parse("")
+	assert.NoError(t, err)
+	assert.Equal(t, "", opts.Format)
+	assert.Equal(t, "preserve", opts.JPEGMode)
+	assert.Nil(t, opts.Background)
+
+	opts, err = parse("format=jpg&quality=75&background=%23ff8000")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "jpeg", opts.Format)
+		assert.Equal(t, "fixed", opts.JPEGMode)
+		assert.Equal(t, 75, opts.JPEGQuality)
+		assert.Equal(t, &color.NRGBA{0xff, 0x80, 0, 0xff}, opts.Background)
+	}
+
+	opts, err = parse("background=fff")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &color.NRGBA{0xff, 0xff, 0xff, 0xff}, opts.Background)
+	}
+
+	// Requests can only shrink the configured maximum size.
+	opts, err = parse("max_width=500&max_height=5000")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 500, opts.MaxWidth)
+		assert.Equal(t, 5000, opts.MaxHeight)
+	}
+
+	config.renditions = []RenditionSpec{
+		{"thumb", 100, 100, "fill", "center"},
+		{"medium", 500, 500, "fit", ""},
+	}
+	opts, err = parse("aspect=16:9")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 16, opts.AspectWidth)
+		assert.Equal(t, 9, opts.AspectHeight)
+		assert.Equal(t, "center", opts.Crop)
+	}
+
+	// Smart cropping applies to the renditions too, without changing the
+	// config.
+	opts, err = parse("aspect=1:1&crop=smart")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "smart", opts.Crop)
+		assert.Equal(t, "smart", opts.Renditions[0].Crop)
+		assert.Equal(t, "", opts.Renditions[1].Crop)
+		assert.Equal(t, "center", config.renditions[0].Crop)
+	}
+
+	opts, err = parse("redact=0,0,10,10,fill&redact=5,5,20,20,blur")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Redaction{
+			{0, 0, 10, 10, "fill"},
+			{5, 5, 20, 20, "blur"},
+		}, opts.Redactions)
+	}
+
+	for _, query := range []string{
+		"redact=0,0,10,10",
+		"aspect=16",
+		"aspect=0:1",
+		"crop=top",
+		"format=gif",
+		"max_width=2000",
+		"max_height=0",
+		"format=bmp",
+		"quality=95",
+		"quality=high",
+		"background=%23ff80",
+		"background=red",
+		"anti_fingerprint=maybe",
+	} {
+		_, err = parse(query)
+		assert.Error(t, err, query)
+	}
+
+	opts, err = parse("anti_fingerprint=true")
+	if assert.NoError(t, err) {
+		assert.True(t, opts.AntiFingerprint)
+	}
+
+	// When every upload has its fingerprint suppressed, clients can't opt
+	// out.
+	config.AntiFingerprint = true
+	_, err = parse("anti_fingerprint=false")
+	assert.Error(t, err)
+	opts, err = parse("anti_fingerprint=true")
+	if assert.NoError(t, err) {
+		assert.True(t, opts.AntiFingerprint)
+	}
+	config.AntiFingerprint = false
+
+	// The watermark can only be changed if one is configured.
+	_, err = parse("watermark=true")
+	assert.Error(t, err)
+
+	watermark := &WatermarkOptions{Text: "example.com"}
+	config.Watermark = WatermarkConfig{Enabled: true, options: watermark}
+	opts, err = parse("")
+	if assert.NoError(t, err) {
+		assert.Equal(t, watermark, opts.Watermark)
+	}
+	opts, err = parse("watermark=false")
+	if assert.NoError(t, err) {
+		assert.Nil(t, opts.Watermark)
+	}
+	config.Watermark.Enabled = false
+	opts, err = parse("watermark=true")
+	if assert.NoError(t, err) {
+		assert.Equal(t, watermark, opts.Watermark)
+	}
+
+	// Choosing what to do with duplicates needs the upload index.
+	duplicates := func(query string) (string, error) {
+		r, err := http.NewRequest("POST", "/upload?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return duplicateAction(r, config)
+	}
+	config.Duplicates.Action = "allow"
+	action, err := duplicates("")
+	assert.NoError(t, err)
+	assert.Equal(t, "allow", action)
+	_, err = duplicates("duplicates=reject")
+	assert.Error(t, err)
+
+	config.DataDir = "/var/lib/imagehost"
+	action, err = duplicates("duplicates=reject")
+	assert.NoError(t, err)
+	assert.Equal(t, "reject", action)
+	_, err = duplicates("duplicates=ignore")
+	assert.Error(t, err)
+
+	config.RequestOptions.Duplicates = false
+	_, err = duplicates("duplicates=link")
+	assert.Error(t, err)
+	config.RequestOptions.Duplicates = true
+
+	// Nothing is allowed unless the config says so.
+	config.RequestOptions = RequestOptionsConfig{}
+	for _, query := range []string{"format=png", "quality=75", "background=%23ffffff", "max_width=10", "aspect=1:1", "crop=smart", "redact=0,0,10,10,fill", "anti_fingerprint=true", "watermark=true"} {
+		_, err = parse(query)
+		assert.Error(t, err, query)
+	}
+}
+
+func TestValidateRequestFormats(t *testing.T) {
+	config := testConfig(t)
+	config.RequestOptions.Formats = []string{"jpeg", "png", "gif", "best"}
+	assert.NoError(t, validateConfig(config))
+
+	// Nothing is published as TIFF.
+	for _, f := range []string{"tiff", "bmp", "webp"} {
+		config.RequestOptions.Formats = []string{"jpeg", f}
+		assert.Error(t, validateConfig(config), f)
+	}
+}
+
+func TestValidateTransformSecret(t *testing.T) {
+	assert.NoError(t, validateTransformSecret(""))
+	assert.NoError(t, validateTransformSecret("3f9a1c0e5b7d2a4886e1f0c9b3d5a7e2"))
+
+	for _, bad := range []string{"changeme", "ChangeMe1234567890", "mysecretsecretsecret", "short"} {
+		assert.Error(t, validateTransformSecret(bad), bad)
+	}
+}
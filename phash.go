@@ -0,0 +1,139 @@
+package main
+
+// This file contains the perceptual hash used to find near-duplicate uploads.
+// It is a "difference hash" (dHash): the image is shrunk to a small grid of
+// grayscale pixels, and bits record whether a pixel is clearly brighter or
+// darker than the one to its right, and the one below it, plus roughly how
+// bright each part of the image is.  That depends only on the broad structure
+// of the image, so re-encoded, rescaled or slightly edited copies get the same
+// hash, or one that differs in only a few bits.
+//
+// Hashes used to be made from 9x8 pixels, and only across, which is too
+// coarse to tell apart images that are mostly one color - screenshots of the
+// same window with different text in it, say.  Those 64-bit hashes are still
+// read from the index, but can only be compared with each other.
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// The width and height of each grid of differences (across and down)
+	// that make up a hash.
+	dHashSize = 32
+
+	// Differences in brightness (out of 255) up to this are treated as
+	// none, so that noise and compression in flat areas don't flip bits.
+	dHashMargin = 4
+
+	// The width and height of the grid of overall brightness levels, and
+	// the number of levels each of its cells is put in.
+	dHashLevelSize = 16
+	dHashLevels    = 4
+
+	// The number of bits in a hash: two for each difference (one for
+	// getting brighter, one for getting darker), and one per level.
+	perceptualHashBits = 2*2*dHashSize*dHashSize + dHashLevelSize*dHashLevelSize*dHashLevels
+)
+
+// perceptualHash is a dHash, as 64-bit words.  It is written out in hex,
+// since JSON numbers can't hold 64 bits in most clients.
+type perceptualHash []uint64
+
+func (h perceptualHash) String() string {
+	buf := make([]byte, 8*len(h))
+	for i, w := range h {
+		binary.BigEndian.PutUint64(buf[8*i:], w)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (h perceptualHash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *perceptualHash) UnmarshalText(text []byte) error {
+	buf, err := hex.DecodeString(string(text))
+	if err != nil || len(buf) == 0 || len(buf)%8 != 0 {
+		return fmt.Errorf("invalid perceptual hash '%s'", text)
+	}
+	*h = make(perceptualHash, len(buf)/8)
+	for i := range *h {
+		(*h)[i] = binary.BigEndian.Uint64(buf[8*i:])
+	}
+	return nil
+}
+
+// Returns whether two hashes were made the same way, so that the distance
+// between them means something.
+func (h perceptualHash) Comparable(other perceptualHash) bool {
+	return len(h) > 0 && len(h) == len(other)
+}
+
+// Returns the number of bits that differ between two comparable hashes, from
+// 0 (the images look the same) to the number of bits in them.
+func (h perceptualHash) Distance(other perceptualHash) int {
+	n := 0
+	for i := range h {
+		x := h[i] ^ other[i]
+		for x != 0 {
+			x &= x - 1
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the dHash of an image.
+func dHash(img image.Image) perceptualHash {
+	h := make(perceptualHash, (perceptualHashBits+63)/64)
+	bit := 0
+	set := func(on bool) {
+		if on {
+			h[bit/64] |= 1 << uint(63-bit%64)
+		}
+		bit++
+	}
+	// Changes either way are recorded, or flat images and ones that only
+	// get brighter would all hash the same.
+	add := func(a, b uint8) {
+		set(int(a) > int(b)+dHashMargin)
+		set(int(b) > int(a)+dHashMargin)
+	}
+
+	across := imaging.Grayscale(imaging.Resize(img, dHashSize+1, dHashSize, imaging.Linear))
+	for y := 0; y < dHashSize; y++ {
+		row := across.Pix[y*across.Stride:]
+		for x := 0; x < dHashSize; x++ {
+			add(row[4*x], row[4*(x+1)])
+		}
+	}
+
+	down := imaging.Grayscale(imaging.Resize(img, dHashSize, dHashSize+1, imaging.Linear))
+	for y := 0; y < dHashSize; y++ {
+		row, next := down.Pix[y*down.Stride:], down.Pix[(y+1)*down.Stride:]
+		for x := 0; x < dHashSize; x++ {
+			add(row[4*x], next[4*x])
+		}
+	}
+
+	// Differences say nothing about how bright an image is overall, so a
+	// coarse grid of brightness levels tells apart, say, a white image from
+	// a black one.  Each level is a bit of its own, so that neighbouring
+	// levels are only one bit apart.
+	levels := imaging.Grayscale(imaging.Resize(img, dHashLevelSize, dHashLevelSize, imaging.Linear))
+	for y := 0; y < dHashLevelSize; y++ {
+		row := levels.Pix[y*levels.Stride:]
+		for x := 0; x < dHashLevelSize; x++ {
+			for l := 0; l < dHashLevels; l++ {
+				set(int(row[4*x]) >= (2*l+1)*256/(2*dHashLevels))
+			}
+		}
+	}
+	return h
+}
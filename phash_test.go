@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPerceptualHashDistance(t *testing.T) {
+	assert.Equal(t, 0, perceptualHash{0x1234}.Distance(perceptualHash{0x1234}))
+	assert.Equal(t, 1, perceptualHash{0}.Distance(perceptualHash{0x8000000000000000}))
+	assert.Equal(t, 64, perceptualHash{0}.Distance(perceptualHash{0xffffffffffffffff}))
+	assert.Equal(t, 3, perceptualHash{0xf0}.Distance(perceptualHash{0xf7}))
+	assert.Equal(t, 4, perceptualHash{0xf0, 1, 0, 0}.Distance(perceptualHash{0xf7, 0, 0, 0}))
+
+	// Hashes of different sizes can't be compared.
+	assert.True(t, perceptualHash{1, 2, 3, 4}.Comparable(perceptualHash{4, 3, 2, 1}))
+	assert.False(t, perceptualHash{1, 2, 3, 4}.Comparable(perceptualHash{1}))
+	assert.False(t, perceptualHash(nil).Comparable(nil))
+}
+
+func TestPerceptualHashJSON(t *testing.T) {
+	data, err := json.Marshal(perceptualHash{0xfedcba9876543210, 0x00000000000000ff, 0, 1})
+	if assert.NoError(t, err) {
+		assert.Equal(t, `"fedcba9876543210`+`00000000000000ff`+`0000000000000000`+`0000000000000001"`, string(data))
+	}
+
+	var h perceptualHash
+	if assert.NoError(t, json.Unmarshal(data, &h)) {
+		assert.Equal(t, perceptualHash{0xfedcba9876543210, 0xff, 0, 1}, h)
+	}
+
+	// Hashes from before they were longer are still read.
+	if assert.NoError(t, json.Unmarshal([]byte(`"00000000000000ff"`), &h)) {
+		assert.Equal(t, perceptualHash{0xff}, h)
+	}
+
+	for _, bad := range []string{`"not a hash"`, `""`, `"00ff"`} {
+		assert.Error(t, json.Unmarshal([]byte(bad), &h), bad)
+	}
+}
+
+func TestDHash(t *testing.T) {
+	orig, err := imaging.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := dHash(orig)
+	assert.Len(t, h, perceptualHashBits/64)
+
+	// Smaller, recompressed copies hash nearly the same.
+	small := imaging.Resize(orig, orig.Bounds().Dx()/3, 0, imaging.Lanczos)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, small, &jpeg.Options{Quality: 40}); err != nil {
+		t.Fatal(err)
+	}
+	copied, _, err := image.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, h.Distance(dHash(copied)) <= 80, "distance %d", h.Distance(dHash(copied)))
+
+	// So do ones that have had a small part changed...
+	edited := CloneToRGBA(orig).(*image.RGBA)
+	b := orig.Bounds()
+	redaction := Redaction{b.Dx() / 10, b.Dy() / 10, b.Dx() / 10, b.Dy() / 10, "fill"}
+	if err := applyRedactions(edited, []Redaction{redaction}); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, h.Distance(dHash(edited)) <= 80, "distance %d", h.Distance(dHash(edited)))
+
+	// ... but not different images.
+	other, err := imaging.Open("exif-orientation-examples/Landscape_1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, h.Distance(dHash(other)) > 400, "distance %d", h.Distance(dHash(other)))
+	assert.True(t, h.Distance(dHash(imaging.FlipH(orig))) > 400)
+}
+
+// Returns something like a screenshot: a white window with a title bar, and
+// lines of "words" of the given lengths.
+func testScreenshot(words []int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 1280, 800))
+	draw.Draw(img, img.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 1280, 40), &image.Uniform{color.Gray{200}}, image.ZP, draw.Src)
+	for line := 0; line < 30; line++ {
+		x, y := 40, 80+line*22
+		for i := 0; i < 12; i++ {
+			w := 8 * words[(line+i)%len(words)]
+			if x+w > 1240 {
+				break
+			}
+			draw.Draw(img, image.Rect(x, y, x+w, y+12), image.Black, image.ZP, draw.Src)
+			x += w + 10
+		}
+	}
+	return img
+}
+
+func TestDHashScreenshots(t *testing.T) {
+	a := dHash(testScreenshot([]int{10, 8, 12, 5, 9, 11}))
+	c := dHash(testScreenshot([]int{6, 12, 4, 9, 11, 3}))
+	blank := image.NewRGBA(image.Rect(0, 0, 1280, 800))
+	draw.Draw(blank, blank.Bounds(), image.White, image.ZP, draw.Src)
+
+	// Windows that only differ in the text in them, or that are empty,
+	// aren't near-duplicates.
+	assert.True(t, a.Distance(c) > 400, "distance %d", a.Distance(c))
+	assert.True(t, a.Distance(dHash(blank)) > 400, "distance %d", a.Distance(dHash(blank)))
+
+	// A smaller, recompressed copy of one is.
+	small := imaging.Resize(testScreenshot([]int{10, 8, 12, 5, 9, 11}), 640, 0, imaging.Lanczos)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, small, &jpeg.Options{Quality: 50}); err != nil {
+		t.Fatal(err)
+	}
+	copied, _, err := image.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, a.Distance(dHash(copied)) <= 80, "distance %d", a.Distance(dHash(copied)))
+}
+
+func TestDHashFlat(t *testing.T) {
+	flat := func(c color.Color) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+		draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.ZP, draw.Src)
+		return img
+	}
+	gradient := image.NewGray(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			gradient.SetGray(x, y, color.Gray{uint8(x * 255 / 399)})
+		}
+	}
+
+	// Images without any detail, or that only get brighter one way, still
+	// aren't near-duplicates of each other.
+	images := []image.Image{
+		flat(color.White),
+		flat(color.Black),
+		flat(color.RGBA{255, 0, 0, 255}),
+		flat(color.Gray{128}),
+		gradient,
+		imaging.Rotate90(gradient),
+		imaging.FlipH(gradient),
+	}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			d := dHash(images[i]).Distance(dHash(images[j]))
+			assert.True(t, d > 200, "images %d and %d: distance %d", i, j, d)
+		}
+	}
+}
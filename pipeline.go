@@ -0,0 +1,74 @@
+package main
+
+// This file contains helpers for running the stages of an upload (archiving,
+// sanitizing, publishing) concurrently.
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var errAborted = errors.New("upload aborted")
+
+// stageError records which stage of the upload pipeline failed, so that we can
+// tell the client something useful about it.
+type stageError struct {
+	err  error
+	meta string
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+// abortSignal is closed when any stage of an upload fails, so that the other
+// stages can stop early instead of finishing work that will be thrown away.
+type abortSignal struct {
+	ch   chan struct{}
+	once sync.Once
+}
+
+func newAbortSignal() *abortSignal {
+	return &abortSignal{ch: make(chan struct{})}
+}
+
+// Abort signals all stages to stop.  It is safe to call more than once, and
+// returns true only for the call that aborted the upload.
+func (a *abortSignal) Abort() bool {
+	first := false
+	a.once.Do(func() {
+		close(a.ch)
+		first = true
+	})
+	return first
+}
+
+// Aborted returns whether Abort has been called.
+func (a *abortSignal) Aborted() bool {
+	select {
+	case <-a.ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reader wraps r so that reads fail once the upload is aborted.  Since S3
+// requests consume their body as they go, this causes an in-flight request to
+// be cut short rather than running to completion.
+func (a *abortSignal) Reader(r io.Reader) io.Reader {
+	return &abortableReader{r: r, abort: a}
+}
+
+type abortableReader struct {
+	r     io.Reader
+	abort *abortSignal
+}
+
+func (r *abortableReader) Read(p []byte) (int, error) {
+	if r.abort.Aborted() {
+		return 0, errAborted
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,150 @@
+package main
+
+// This file contains the code that makes placeholders for published images:
+// small things that clients can show while the real image loads.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+
+	"github.com/disintegration/imaging"
+)
+
+// Placeholder describes an image in a few hundred bytes.
+type Placeholder struct {
+	// A BlurHash of the image (see encodeBlurHash).
+	BlurHash string `json:"blurhash"`
+
+	// A tiny, blurry JPEG of the image, as a data URI.
+	LQIP string `json:"lqip"`
+
+	// The most common color in the image, and its average color, as
+	// "#rrggbb".
+	DominantColor string `json:"dominant_color"`
+	AverageColor  string `json:"average_color"`
+}
+
+const (
+	// The largest side of the LQIP, in pixels, and its JPEG quality.
+	lqipSize    = 16
+	lqipQuality = 40
+
+	// The number of colors the image is reduced to to find its dominant
+	// color.
+	dominantColors = 6
+)
+
+// The S3 metadata that placeholders are stored in, on the public image.
+const (
+	blurHashHeader      = "x-amz-meta-blurhash"
+	lqipHeader          = "x-amz-meta-lqip"
+	dominantColorHeader = "x-amz-meta-dominant-color"
+	averageColorHeader  = "x-amz-meta-average-color"
+)
+
+// S3 allows 2 KiB of metadata on each object, so longer LQIPs aren't stored.
+const maxLQIPMetadata = 1536
+
+// Makes the placeholder for an image.  Transparent areas are shown on the
+// background color, as they would be in a JPEG.
+func makePlaceholder(img image.Image, background *color.NRGBA) (*Placeholder, error) {
+	small := flatten(imaging.Fit(img, blurHashSize, blurHashSize, imaging.Box), background)
+
+	// Landscape images get more components across than down, and portrait
+	// ones the other way around.
+	xc, yc := 4, 3
+	if b := small.Bounds(); b.Dy() > b.Dx() {
+		xc, yc = 3, 4
+	}
+
+	var buf bytes.Buffer
+	lqip := imaging.Blur(imaging.Fit(small, lqipSize, lqipSize, imaging.Lanczos), 0.5)
+	if err := jpeg.Encode(&buf, lqip, &jpeg.Options{Quality: lqipQuality}); err != nil {
+		return nil, err
+	}
+
+	return &Placeholder{
+		BlurHash:      encodeBlurHash(small, xc, yc),
+		LQIP:          "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+		DominantColor: hexColor(dominantColor(small)),
+		AverageColor:  hexColor(averageColor(small)),
+	}, nil
+}
+
+// Returns the color that covers most of an opaque image.  The image is
+// reduced to a few colors first, so that similar shades count together.
+func dominantColor(img image.Image) color.NRGBA {
+	palette := medianCut(img, dominantColors)
+	counts := make([]int, len(palette))
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			counts[palette.Index(img.At(x, y))]++
+		}
+	}
+
+	best := 0
+	for i := range counts {
+		if counts[i] > counts[best] {
+			best = i
+		}
+	}
+	return palette[best].(color.NRGBA)
+}
+
+// Returns the average color of an opaque image.
+func averageColor(img image.Image) color.NRGBA {
+	var r, g, b, n int
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			r += int(c.R)
+			g += int(c.G)
+			b += int(c.B)
+			n++
+		}
+	}
+	if n == 0 {
+		return color.NRGBA{A: 0xff}
+	}
+	return color.NRGBA{uint8(r / n), uint8(g / n), uint8(b / n), 0xff}
+}
+
+func hexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// Returns the S3 metadata headers for a placeholder.
+func (p *Placeholder) Headers() map[string][]string {
+	headers := map[string][]string{
+		blurHashHeader:      {p.BlurHash},
+		dominantColorHeader: {p.DominantColor},
+		averageColorHeader:  {p.AverageColor},
+	}
+	if len(p.LQIP) <= maxLQIPMetadata {
+		headers[lqipHeader] = []string{p.LQIP}
+	}
+	return headers
+}
+
+// Reads a placeholder back from the headers of an S3 object, returning nil if
+// it doesn't have one.
+func placeholderFromHeaders(h http.Header) *Placeholder {
+	p := &Placeholder{
+		BlurHash:      h.Get(blurHashHeader),
+		LQIP:          h.Get(lqipHeader),
+		DominantColor: h.Get(dominantColorHeader),
+		AverageColor:  h.Get(averageColorHeader),
+	}
+	if len(p.BlurHash) == 0 {
+		return nil
+	}
+	return p
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakePlaceholder(t *testing.T) {
+	img, err := imaging.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := makePlaceholder(img, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// test.jpg is taller than it is wide.
+	assert.Equal(t, encodeBlurHash(img, 3, 4), p.BlurHash)
+
+	// The LQIP is a tiny JPEG, small enough to keep in the S3 metadata.
+	const prefix = "data:image/jpeg;base64,"
+	if assert.True(t, strings.HasPrefix(p.LQIP, prefix)) {
+		data, err := base64.StdEncoding.DecodeString(p.LQIP[len(prefix):])
+		if assert.NoError(t, err) {
+			lqip, err := jpeg.Decode(strings.NewReader(string(data)))
+			if assert.NoError(t, err) {
+				b := lqip.Bounds()
+				assert.Equal(t, lqipSize, b.Dy())
+				assert.True(t, b.Dx() < lqipSize)
+			}
+		}
+	}
+	assert.True(t, len(p.LQIP) <= maxLQIPMetadata, "LQIP is %d bytes", len(p.LQIP))
+	assert.Regexp(t, "^#[0-9a-f]{6}$", p.DominantColor)
+	assert.Regexp(t, "^#[0-9a-f]{6}$", p.AverageColor)
+}
+
+func TestPlaceholderColors(t *testing.T) {
+	// Three quarters blue, one quarter (transparent) red.
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{0, 0, 0xff, 0xff}), image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 40, 10), image.NewUniform(color.NRGBA{0xff, 0, 0, 0x80}), image.ZP, draw.Src)
+
+	p, err := makePlaceholder(img, &color.NRGBA{0xff, 0xff, 0xff, 0xff})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "#0000ff", p.DominantColor)
+
+		// The red is drawn half-transparent over white.
+		assert.Equal(t, "#3f1fdf", p.AverageColor)
+	}
+}
+
+func TestPlaceholderHeaders(t *testing.T) {
+	p := &Placeholder{"LEHV6nWB2yk8", "data:image/jpeg;base64,AAAA", "#102030", "#405060"}
+
+	h := http.Header{}
+	for k, v := range p.Headers() {
+		h[http.CanonicalHeaderKey(k)] = v
+	}
+	assert.Equal(t, p, placeholderFromHeaders(h))
+
+	// LQIPs that won't fit in the metadata are left out.
+	p.LQIP = strings.Repeat("A", maxLQIPMetadata+1)
+	_, found := p.Headers()[lqipHeader]
+	assert.False(t, found)
+
+	assert.Nil(t, placeholderFromHeaders(http.Header{}))
+}
@@ -0,0 +1,319 @@
+package main
+
+// This file contains code to pick the quality JPEGs are re-encoded with:
+// either by estimating the quality the original was saved with, or by
+// searching for the quality that meets a size or similarity target.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+)
+
+// The standard luminance quantization table from the JPEG specification
+// (Annex K), in zig-zag order.  Encoders based on libjpeg - including Go's -
+// produce their tables by scaling this one according to the quality setting.
+var stdLuminanceQuant = [64]int{
+	16, 11, 12, 14, 12, 10, 16, 14,
+	13, 14, 18, 17, 16, 19, 24, 40,
+	26, 24, 22, 22, 24, 49, 35, 37,
+	29, 40, 58, 51, 61, 60, 57, 51,
+	56, 55, 64, 72, 92, 78, 64, 68,
+	87, 69, 55, 56, 80, 109, 81, 87,
+	95, 98, 103, 104, 103, 62, 77, 113,
+	121, 112, 100, 120, 92, 101, 103, 99,
+}
+
+var errNoQuantTable = errors.New("no luminance quantization table found")
+
+// Estimates the quality (1-100) that a JPEG image was encoded with, by
+// comparing its luminance quantization table against the standard one.  The
+// reader is rewound afterwards.
+func estimateJPEGQuality(r io.ReadSeeker) (int, error) {
+	defer r.Seek(0, 0)
+
+	table, err := findLuminanceTable(r)
+	if err != nil {
+		return 0, err
+	}
+
+	// libjpeg scales the standard table by a percentage derived from the
+	// quality, so invert that: find the average scale factor that was used...
+	var scale float64
+	for i, q := range table {
+		scale += float64(q) * 100 / float64(stdLuminanceQuant[i])
+	}
+	scale /= 64
+
+	// ... and then the quality that gives that scale.
+	var quality float64
+	if scale <= 100 {
+		quality = (200 - scale) / 2
+	} else {
+		quality = 5000 / scale
+	}
+
+	return clampInt(int(quality+0.5), 1, 100), nil
+}
+
+// Reads JPEG segments up until the start of the image data, looking for the
+// quantization table with ID 0, which is conventionally used for luminance.
+func findLuminanceTable(r io.Reader) ([64]int, error) {
+	var table [64]int
+
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return table, err
+	}
+	if buf[0] != 0xff || buf[1] != 0xd8 {
+		return table, errors.New("missing JPEG SOI marker")
+	}
+
+	for {
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return table, err
+		}
+		if buf[0] != 0xff {
+			return table, errors.New("invalid JPEG marker")
+		}
+
+		marker := buf[1]
+		length := int(binary.BigEndian.Uint16(buf[2:])) - 2
+		if length < 0 {
+			return table, errors.New("invalid JPEG segment length")
+		}
+
+		// Start of scan - the tables must all have been seen by now.
+		if marker == 0xda {
+			return table, errNoQuantTable
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return table, err
+		}
+		if marker != 0xdb {
+			continue
+		}
+
+		// A DQT segment may contain several tables, each of which is a
+		// precision/ID byte followed by 64 8- or 16-bit values.
+		for len(data) > 0 {
+			precision, id := data[0]>>4, data[0]&0x0f
+			data = data[1:]
+
+			size := 64
+			if precision != 0 {
+				size = 128
+			}
+			if len(data) < size {
+				return table, errors.New("short JPEG quantization table")
+			}
+
+			if id == 0 {
+				for i := range table {
+					if precision != 0 {
+						table[i] = int(binary.BigEndian.Uint16(data[2*i:]))
+					} else {
+						table[i] = int(data[i])
+					}
+				}
+				return table, nil
+			}
+			data = data[size:]
+		}
+	}
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// Encodes img as a JPEG, binary-searching the quality range for the setting
+// that best meets the target of the given mode:
+//
+//	max_size - the highest quality whose output is at most opts.JPEGMaxBytes
+//	min_ssim - the lowest quality whose output has an SSIM against img of at
+//	           least opts.JPEGMinSSIM
+//
+// If no quality in the range meets the target, the closest one is used and
+// met is false.  The SSIM is only computed in min_ssim mode.
+func encodeJPEGToTarget(img image.Image, opts *SanitizeOptions) (data []byte, quality int, ssim float64, met bool, err error) {
+	var source *lumaPlane
+	if opts.JPEGMode == "min_ssim" {
+		source = newLumaPlane(img)
+	}
+
+	type candidate struct {
+		data []byte
+		ssim float64
+	}
+	tried := map[int]*candidate{}
+
+	encode := func(q int) (*candidate, error) {
+		if c, ok := tried[q]; ok {
+			return c, nil
+		}
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: q}); err != nil {
+			return nil, err
+		}
+		c := &candidate{data: buf.Bytes()}
+
+		if source != nil {
+			decoded, err := jpeg.Decode(bytes.NewReader(c.data))
+			if err != nil {
+				return nil, err
+			}
+			c.ssim = source.SSIM(newLumaPlane(decoded))
+		}
+
+		tried[q] = c
+		return c, nil
+	}
+
+	lo, hi := opts.MinJPEGQuality, opts.MaxJPEGQuality
+	best := -1
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		c, err := encode(mid)
+		if err != nil {
+			return nil, 0, 0, false, err
+		}
+
+		switch opts.JPEGMode {
+		case "max_size":
+			if int64(len(c.data)) <= opts.JPEGMaxBytes {
+				best, lo = mid, mid+1
+			} else {
+				hi = mid - 1
+			}
+		case "min_ssim":
+			if c.ssim >= opts.JPEGMinSSIM {
+				best, hi = mid, mid-1
+			} else {
+				lo = mid + 1
+			}
+		default:
+			return nil, 0, 0, false, fmt.Errorf("unknown JPEG mode: %s", opts.JPEGMode)
+		}
+	}
+
+	met = best >= 0
+	if !met {
+		// Nothing was good enough - get as close as we can.
+		best = opts.MinJPEGQuality
+		if opts.JPEGMode == "min_ssim" {
+			best = opts.MaxJPEGQuality
+		}
+	}
+
+	c, err := encode(best)
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	return c.data, best, c.ssim, met, nil
+}
+
+// lumaPlane holds the luma (Y) channel of an image, as a JPEG encoder would
+// compute it.
+type lumaPlane struct {
+	w, h int
+	pix  []uint8
+}
+
+func newLumaPlane(img image.Image) *lumaPlane {
+	b := img.Bounds()
+	p := &lumaPlane{w: b.Dx(), h: b.Dy(), pix: make([]uint8, b.Dx()*b.Dy())}
+
+	switch src := img.(type) {
+	case *image.YCbCr:
+		for y := 0; y < p.h; y++ {
+			off := (y+b.Min.Y-src.Rect.Min.Y)*src.YStride + (b.Min.X - src.Rect.Min.X)
+			copy(p.pix[y*p.w:(y+1)*p.w], src.Y[off:off+p.w])
+		}
+
+	case *image.RGBA:
+		for y := 0; y < p.h; y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < p.w; x++ {
+				yy, _, _ := color.RGBToYCbCr(row[4*x], row[4*x+1], row[4*x+2])
+				p.pix[y*p.w+x] = yy
+			}
+		}
+
+	default:
+		for y := 0; y < p.h; y++ {
+			for x := 0; x < p.w; x++ {
+				r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				yy, _, _ := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+				p.pix[y*p.w+x] = yy
+			}
+		}
+	}
+
+	return p
+}
+
+// SSIM computes the mean structural similarity between two luma planes of the
+// same size, over non-overlapping 8x8 windows.  1 means the planes are
+// identical.
+func (p *lumaPlane) SSIM(other *lumaPlane) float64 {
+	const (
+		window = 8
+		c1     = (0.01 * 255) * (0.01 * 255)
+		c2     = (0.03 * 255) * (0.03 * 255)
+	)
+
+	if p.w != other.w || p.h != other.h {
+		return 0
+	}
+
+	var total float64
+	var count int
+	for wy := 0; wy < p.h; wy += window {
+		for wx := 0; wx < p.w; wx += window {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			n := 0
+			for y := wy; y < wy+window && y < p.h; y++ {
+				for x := wx; x < wx+window && x < p.w; x++ {
+					a := float64(p.pix[y*p.w+x])
+					b := float64(other.pix[y*p.w+x])
+					sumA += a
+					sumB += b
+					sumAA += a * a
+					sumBB += b * b
+					sumAB += a * b
+					n++
+				}
+			}
+
+			fn := float64(n)
+			meanA, meanB := sumA/fn, sumB/fn
+			varA := sumAA/fn - meanA*meanA
+			varB := sumBB/fn - meanB*meanB
+			cov := sumAB/fn - meanA*meanB
+
+			total += ((2*meanA*meanB + c1) * (2*cov + c2)) /
+				((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 1
+	}
+	return total / float64(count)
+}
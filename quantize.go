@@ -0,0 +1,307 @@
+package main
+
+// This file contains the code that reduces images to the 256 colors GIF can
+// store.  Images that were paletted to begin with keep their own palette; any
+// others are quantized with median cut, optionally with Floyd-Steinberg
+// dithering to hide the banding that leaves in gradients.
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"sort"
+)
+
+// Pixels less opaque than this become fully transparent in a GIF.
+const gifAlphaThreshold = 0x80
+
+// Encodes img as a GIF.  Paletted images are written with the palette they
+// already have; anything else is quantized first.
+func encodeGIF(w io.Writer, img image.Image, dither bool) error {
+	p, ok := img.(*image.Paletted)
+	if !ok {
+		p = quantize(img, 256, dither)
+	}
+	return gif.Encode(w, p, nil)
+}
+
+// Converts an image back to the palette it was originally decoded with, after
+// it was cloned to RGBA so that it could be rotated.  Since only the positions
+// of the pixels have changed, every color should be in the palette - if one
+// isn't, false is returned.
+func repalette(img image.Image, palette color.Palette) (*image.Paletted, bool) {
+	// Key on the premultiplied color, which is what the RGBA clone holds, so
+	// that every fully transparent entry maps to the same thing.
+	index := make(map[color.RGBA]uint8, len(palette))
+	for i := len(palette) - 1; i >= 0; i-- {
+		index[color.RGBAModel.Convert(palette[i]).(color.RGBA)] = uint8(i)
+	}
+
+	b := img.Bounds()
+	dst := image.NewPaletted(b, palette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i, ok := index[color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)]
+			if !ok {
+				return nil, false
+			}
+			dst.SetColorIndex(x, y, i)
+		}
+	}
+	return dst, true
+}
+
+// The quantizer works on a histogram of colors reduced to 5 bits per channel.
+const (
+	histBits = 5
+	histSize = 1 << histBits
+)
+
+func histIndex(r, g, b uint8) int {
+	const shift = 8 - histBits
+	return int(r>>shift)<<(2*histBits) | int(g>>shift)<<histBits | int(b>>shift)
+}
+
+// histEntry holds the number of pixels that fell into a histogram bin, and the
+// sums of their full-precision colors, so that the average can be found.
+type histEntry struct {
+	count      int
+	r, g, b    int
+	cr, cg, cb uint8
+}
+
+// colorBox is a box in RGB space, holding some of the histogram's entries.
+type colorBox struct {
+	entries []*histEntry
+	count   int
+}
+
+// Returns the channel (0-2) along which the box's colors are most spread out,
+// and how far.
+func (c *colorBox) widest() (int, int) {
+	lo := [3]uint8{0xff, 0xff, 0xff}
+	hi := [3]uint8{}
+	for _, e := range c.entries {
+		for ch, v := range [3]uint8{e.cr, e.cg, e.cb} {
+			if v < lo[ch] {
+				lo[ch] = v
+			}
+			if v > hi[ch] {
+				hi[ch] = v
+			}
+		}
+	}
+
+	channel, width := 0, -1
+	for ch := range lo {
+		if w := int(hi[ch]) - int(lo[ch]); w > width {
+			channel, width = ch, w
+		}
+	}
+	return channel, width
+}
+
+// Splits the box at the median pixel along its widest channel.
+func (c *colorBox) split() (*colorBox, *colorBox) {
+	channel, _ := c.widest()
+	sort.Sort(byChannel{c.entries, channel})
+
+	// Stop before the last entry, so that neither half is empty.
+	seen, i := c.entries[0].count, 0
+	for i < len(c.entries)-2 && seen*2 < c.count {
+		i++
+		seen += c.entries[i].count
+	}
+
+	a := &colorBox{entries: c.entries[:i+1], count: seen}
+	b := &colorBox{entries: c.entries[i+1:], count: c.count - seen}
+	return a, b
+}
+
+// Returns the average color of the pixels in the box.
+func (c *colorBox) average() color.NRGBA {
+	var r, g, b int
+	for _, e := range c.entries {
+		r += e.r
+		g += e.g
+		b += e.b
+	}
+	return color.NRGBA{uint8(r / c.count), uint8(g / c.count), uint8(b / c.count), 0xff}
+}
+
+type byChannel struct {
+	entries []*histEntry
+	channel int
+}
+
+func (s byChannel) Len() int      { return len(s.entries) }
+func (s byChannel) Swap(i, j int) { s.entries[i], s.entries[j] = s.entries[j], s.entries[i] }
+func (s byChannel) Less(i, j int) bool {
+	a, b := s.entries[i], s.entries[j]
+	switch s.channel {
+	case 0:
+		return a.cr < b.cr
+	case 1:
+		return a.cg < b.cg
+	}
+	return a.cb < b.cb
+}
+
+// Builds a palette of at most n colors for img using median cut.  If the image
+// has transparent pixels, the last entry of the palette is transparent.
+func medianCut(img image.Image, n int) color.Palette {
+	hist := make([]*histEntry, histSize*histSize*histSize)
+	var entries []*histEntry
+	hasAlpha := false
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < gifAlphaThreshold {
+				hasAlpha = true
+				continue
+			}
+
+			i := histIndex(c.R, c.G, c.B)
+			e := hist[i]
+			if e == nil {
+				e = &histEntry{cr: c.R, cg: c.G, cb: c.B}
+				hist[i] = e
+				entries = append(entries, e)
+			}
+			e.count++
+			e.r += int(c.R)
+			e.g += int(c.G)
+			e.b += int(c.B)
+		}
+	}
+
+	if hasAlpha {
+		n--
+	}
+
+	// Use each bin's average as its position, so boxes split on real colors.
+	total := 0
+	for _, e := range entries {
+		e.cr, e.cg, e.cb = uint8(e.r/e.count), uint8(e.g/e.count), uint8(e.b/e.count)
+		total += e.count
+	}
+
+	var boxes []*colorBox
+	if len(entries) > 0 {
+		boxes = append(boxes, &colorBox{entries: entries, count: total})
+	}
+
+	// Keep splitting the box with the widest spread of colors, weighted by
+	// how many pixels it covers, until we have enough.
+	for len(boxes) < n {
+		best, bestScore := -1, 0
+		for i, box := range boxes {
+			if len(box.entries) < 2 {
+				continue
+			}
+			_, width := box.widest()
+			if score := width * box.count; best < 0 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		a, b := boxes[best].split()
+		boxes[best] = a
+		boxes = append(boxes, b)
+	}
+
+	palette := make(color.Palette, 0, len(boxes)+1)
+	for _, box := range boxes {
+		palette = append(palette, box.average())
+	}
+	if hasAlpha {
+		palette = append(palette, color.NRGBA{})
+	}
+	return palette
+}
+
+// Reduces img to a paletted image of at most n colors.
+func quantize(img image.Image, n int, dither bool) *image.Paletted {
+	palette := medianCut(img, n)
+	b := img.Bounds()
+	dst := image.NewPaletted(b, palette)
+
+	transparent := -1
+	opaque := palette
+	if len(palette) > 0 {
+		if _, _, _, a := palette[len(palette)-1].RGBA(); a == 0 {
+			transparent = len(palette) - 1
+			opaque = palette[:transparent]
+		}
+	}
+	if len(opaque) == 0 {
+		// Everything is transparent.
+		return dst
+	}
+
+	// Searching the palette for every pixel is slow, so remember the answer
+	// for each histogram bin.
+	nearest := make([]int16, histSize*histSize*histSize)
+	for i := range nearest {
+		nearest[i] = -1
+	}
+	lookup := func(r, g, b uint8) uint8 {
+		i := histIndex(r, g, b)
+		if nearest[i] < 0 {
+			nearest[i] = int16(opaque.Index(color.NRGBA{r, g, b, 0xff}))
+		}
+		return uint8(nearest[i])
+	}
+
+	// The errors carried to the current and next row, with a pixel of padding
+	// on either side.
+	w := b.Dx()
+	cur := make([][3]int, w+2)
+	next := make([][3]int, w+2)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < gifAlphaThreshold {
+				dst.SetColorIndex(x, y, uint8(transparent))
+				continue
+			}
+
+			if !dither {
+				dst.SetColorIndex(x, y, lookup(c.R, c.G, c.B))
+				continue
+			}
+
+			i := x - b.Min.X + 1
+			want := [3]int{
+				clampInt(int(c.R)+cur[i][0]/16, 0, 0xff),
+				clampInt(int(c.G)+cur[i][1]/16, 0, 0xff),
+				clampInt(int(c.B)+cur[i][2]/16, 0, 0xff),
+			}
+			idx := lookup(uint8(want[0]), uint8(want[1]), uint8(want[2]))
+			dst.SetColorIndex(x, y, idx)
+
+			got := opaque[idx].(color.NRGBA)
+			for ch, v := range [3]uint8{got.R, got.G, got.B} {
+				e := want[ch] - int(v)
+				cur[i+1][ch] += e * 7
+				next[i-1][ch] += e * 3
+				next[i][ch] += e * 5
+				next[i+1][ch] += e * 1
+			}
+		}
+
+		cur, next = next, cur
+		for i := range next {
+			next[i] = [3]int{}
+		}
+	}
+
+	return dst
+}
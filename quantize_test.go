@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGIFKeepsPalette(t *testing.T) {
+	palette := color.Palette{
+		color.NRGBA{0xff, 0, 0, 0xff},
+		color.NRGBA{0xff, 0xff, 0xff, 0}, // transparent, but not black
+		color.NRGBA{0, 0, 0xff, 0xff},
+	}
+	img := image.NewPaletted(image.Rect(0, 0, 40, 30), palette)
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			img.SetColorIndex(x, y, uint8((x/10+y/10)%3))
+		}
+	}
+
+	var in bytes.Buffer
+	assert.NoError(t, gif.Encode(&in, img, nil))
+
+	out, res, err := SanitizeImageFrom(bytes.NewReader(in.Bytes()), &SanitizeOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "gif", res.Format)
+
+	decoded, err := gif.Decode(out)
+	if !assert.NoError(t, err) {
+		return
+	}
+	p := decoded.(*image.Paletted)
+	// The decoder pads the palette to a power of two.
+	if assert.True(t, len(p.Palette) >= len(palette)) {
+		for i, c := range palette {
+			assert.Equal(t, color.RGBAModel.Convert(c), p.Palette[i])
+		}
+	}
+	assert.Equal(t, img.Pix, p.Pix)
+}
+
+func TestMedianCutUnevenColors(t *testing.T) {
+	// Nearly all of the pixels are one color, so splitting at the median
+	// used to leave an empty box, which came out as a black palette entry.
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.Set(0, 0, color.NRGBA{0xff, 0, 0, 0xff})
+	img.Set(1, 0, color.NRGBA{0, 0xff, 0, 0xff})
+
+	palette := medianCut(img, 4)
+	assert.Len(t, palette, 3)
+	for _, c := range palette {
+		assert.NotEqual(t, color.NRGBA{0, 0, 0, 0xff}, c)
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	// A smooth gradient with far more than 256 colors, and a transparent
+	// stripe down the side.
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 128))
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 256; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x), uint8(y * 2), uint8(255 - x), 0xff})
+		}
+		for x := 0; x < 8; x++ {
+			img.Set(x, y, color.NRGBA{})
+		}
+	}
+
+	opaque := img.SubImage(image.Rect(8, 0, 256, 128))
+	var diffs [2]float64
+	for i, dither := range []bool{false, true} {
+		q := quantize(img, 256, dither)
+		assert.True(t, len(q.Palette) <= 256)
+
+		_, _, _, a := q.At(0, 0).RGBA()
+		assert.Equal(t, uint32(0), a, "transparency should be kept")
+		_, _, _, a = q.At(100, 100).RGBA()
+		assert.Equal(t, uint32(0xffff), a)
+
+		diffs[i] = imageDifference(opaque, q.SubImage(opaque.Bounds()))
+		assert.True(t, diffs[i] < 4, "quantized image is too different: %f", diffs[i])
+	}
+
+	// Dithering should bring the average color of each area closer to the
+	// original.
+	assert.True(t, diffs[1] <= diffs[0], "dithered: %f, not dithered: %f", diffs[1], diffs[0])
+}
+
+func TestColorBoxSplit(t *testing.T) {
+	// Most of the pixels are in the last entry, so the median falls there -
+	// but both halves still need some of the entries.
+	box := &colorBox{
+		entries: []*histEntry{
+			{count: 1, cr: 10},
+			{count: 1, cr: 20},
+			{count: 10, cr: 30},
+		},
+		count: 12,
+	}
+	a, b := box.split()
+	assert.Len(t, a.entries, 2)
+	assert.Equal(t, 2, a.count)
+	assert.Len(t, b.entries, 1)
+	assert.Equal(t, 10, b.count)
+}
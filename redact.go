@@ -0,0 +1,169 @@
+package main
+
+// This file contains the code that redacts parts of an image.  Redactions are
+// meant to hide things like names and tokens in screenshots, so every mode
+// throws the original pixels away rather than just obscuring them: a plain
+// blur or a fine pixelation can often be reversed, especially on text.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Redaction is a rectangle of an image to redact, in the coordinates of the
+// image after it has been rotated upright.
+type Redaction struct {
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Mode   string `json:"mode"`
+}
+
+// The smallest block that redacted regions are divided into.  Blocks are
+// otherwise as large as the shorter side of the region: a redacted line of
+// text is usually one block high, and several blocks across its height would
+// leave enough of the shapes of the letters to guess at them.  Pixelated
+// regions are filled with a color per block, and blurred ones are reduced to
+// a sample per block.
+const minRedactionBlock = 16
+
+// How much random noise (+/-) is added to each channel of the samples that
+// are kept, so that they can't be matched against candidate originals.
+const redactionNoise = 12
+
+// Parses a redaction given as "X,Y,WIDTH,HEIGHT,MODE", where the mode is one
+// of "blur", "pixelate" or "fill".
+func parseRedaction(s string) (Redaction, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 5 {
+		return Redaction{}, fmt.Errorf("redaction must look like 'X,Y,WIDTH,HEIGHT,MODE'")
+	}
+
+	var nums [4]int
+	for i := range nums {
+		n, err := strconv.Atoi(strings.TrimSpace(parts[i]))
+		if err != nil || n < 0 {
+			return Redaction{}, fmt.Errorf("redaction '%s' has an invalid number", s)
+		}
+		nums[i] = n
+	}
+	if nums[2] == 0 || nums[3] == 0 {
+		return Redaction{}, fmt.Errorf("redaction '%s' is empty", s)
+	}
+
+	mode := strings.TrimSpace(parts[4])
+	switch mode {
+	case "blur", "pixelate", "fill":
+	default:
+		return Redaction{}, fmt.Errorf("unknown redaction mode '%s'", mode)
+	}
+
+	return Redaction{nums[0], nums[1], nums[2], nums[3], mode}, nil
+}
+
+// Applies redactions to an image, in place.  Regions are clipped to the
+// image, but one that misses the image entirely is an error - it probably
+// means the client got the coordinates wrong, and we'd rather not publish
+// what it meant to hide.
+func applyRedactions(img *image.RGBA, redactions []Redaction) error {
+	// The noise has to be unpredictable, or it could be subtracted again.
+	rng, err := newSecureRand()
+	if err != nil {
+		return err
+	}
+
+	for _, red := range redactions {
+		r := image.Rect(red.X, red.Y, red.X+red.Width, red.Y+red.Height).Add(img.Rect.Min)
+		r = r.Intersect(img.Rect)
+		if r.Empty() {
+			return fmt.Errorf("redaction %d,%d,%d,%d is outside the %dx%d image",
+				red.X, red.Y, red.Width, red.Height, img.Rect.Dx(), img.Rect.Dy())
+		}
+
+		switch red.Mode {
+		case "fill":
+			draw.Draw(img, r, image.Black, image.ZP, draw.Src)
+		case "pixelate":
+			pixelate(img, r, rng)
+		case "blur":
+			blurRegion(img, r, rng)
+		default:
+			return fmt.Errorf("unknown redaction mode: %s", red.Mode)
+		}
+	}
+
+	return nil
+}
+
+// Returns the size of the blocks that a region is redacted in.
+func redactionBlock(r image.Rectangle) int {
+	block := r.Dx()
+	if r.Dy() < block {
+		block = r.Dy()
+	}
+	if block < minRedactionBlock {
+		block = minRedactionBlock
+	}
+	return block
+}
+
+// Replaces each block of a region with its average color, plus some noise.
+func pixelate(img *image.RGBA, r image.Rectangle, rng *rand.Rand) {
+	block := redactionBlock(r)
+	for by := r.Min.Y; by < r.Max.Y; by += block {
+		for bx := r.Min.X; bx < r.Max.X; bx += block {
+			b := image.Rect(bx, by, bx+block, by+block).Intersect(r)
+
+			var sum [4]int
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				row := img.Pix[img.PixOffset(b.Min.X, y):]
+				for x := 0; x < b.Dx(); x++ {
+					for ch := range sum {
+						sum[ch] += int(row[4*x+ch])
+					}
+				}
+			}
+
+			n := b.Dx() * b.Dy()
+			c := addNoise(color.RGBA{
+				uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), uint8(sum[3] / n),
+			}, rng)
+			draw.Draw(img, b, image.NewUniform(c), image.ZP, draw.Src)
+		}
+	}
+}
+
+// Blurs a region.  Blurs can be undone if the kernel is known, so the region
+// is first reduced to a few noisy samples, which is what destroys the
+// original; the blur just makes the result look smooth.
+func blurRegion(img *image.RGBA, r image.Rectangle, rng *rand.Rand) {
+	block := redactionBlock(r)
+	sw := (r.Dx() + block - 1) / block
+	sh := (r.Dy() + block - 1) / block
+	samples := imaging.Resize(img.SubImage(r), sw, sh, imaging.Box)
+
+	for i := 0; i+3 < len(samples.Pix); i += 4 {
+		c := addNoise(color.RGBA{samples.Pix[i], samples.Pix[i+1], samples.Pix[i+2], 0xff}, rng)
+		samples.Pix[i], samples.Pix[i+1], samples.Pix[i+2] = c.R, c.G, c.B
+	}
+
+	smooth := imaging.Resize(samples, r.Dx(), r.Dy(), imaging.Linear)
+	smooth = imaging.Blur(smooth, float64(block)/2)
+	draw.Draw(img, r, smooth, image.ZP, draw.Src)
+}
+
+func addNoise(c color.RGBA, rng *rand.Rand) color.RGBA {
+	noise := func(v uint8) uint8 {
+		n := int(v) + rng.Intn(2*redactionNoise+1) - redactionNoise
+		return uint8(clampInt(n, 0, int(c.A)))
+	}
+	return color.RGBA{noise(c.R), noise(c.G), noise(c.B), c.A}
+}
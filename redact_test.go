@@ -0,0 +1,150 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRedaction(t *testing.T) {
+	red, err := parseRedaction("10,20,300,40,blur")
+	if assert.NoError(t, err) {
+		assert.Equal(t, Redaction{10, 20, 300, 40, "blur"}, red)
+	}
+
+	for _, bad := range []string{
+		"",
+		"10,20,300,40",
+		"10,20,300,40,erase",
+		"10,20,0,40,fill",
+		"-10,20,300,40,fill",
+		"a,20,300,40,fill",
+		"10,20,300,40,fill,extra",
+	} {
+		_, err := parseRedaction(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+// Returns the variance of the luma of the pixels in r.
+func lumaVariance(img image.Image, r image.Rectangle) float64 {
+	var sum, sumSq float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			v := float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			sum += v
+			sumSq += v * v
+		}
+	}
+	n := float64(r.Dx() * r.Dy())
+	mean := sum / n
+	return sumSq/n - mean*mean
+}
+
+func TestApplyRedactions(t *testing.T) {
+	region := image.Rect(20, 30, 120, 70)
+	outside := image.Rect(150, 0, 200, 100)
+
+	for _, mode := range []string{"fill", "pixelate", "blur"} {
+		orig := noisyImage(200, 100, image.Rect(0, 0, 200, 100))
+		img := CloneToRGBA(orig).(*image.RGBA)
+
+		err := applyRedactions(img, []Redaction{{20, 30, 100, 40, mode}})
+		if !assert.NoError(t, err, mode) {
+			continue
+		}
+
+		// Everything outside the region is left alone.
+		for y := outside.Min.Y; y < outside.Max.Y; y++ {
+			for x := outside.Min.X; x < outside.Max.X; x++ {
+				if !assert.Equal(t, orig.At(x, y), img.At(x, y), mode) {
+					t.FailNow()
+				}
+			}
+		}
+
+		// Nothing of the noise inside it is left.
+		before := lumaVariance(orig, region)
+		after := lumaVariance(img, region)
+		assert.True(t, after < before/20, "%s: variance %f -> %f", mode, before, after)
+
+		switch mode {
+		case "fill":
+			assert.Equal(t, float64(0), after)
+			assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, img.At(50, 50))
+		case "pixelate":
+			// Blocks are as large as the shorter side of the region.
+			for y := region.Min.Y; y < region.Max.Y; y++ {
+				for x := region.Min.X; x < region.Min.X+region.Dy(); x++ {
+					assert.Equal(t, img.At(region.Min.X, region.Min.Y), img.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestBlurText(t *testing.T) {
+	// Something like a line of text: dark strokes on a light background.
+	img := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	draw.Draw(img, img.Bounds(), image.White, image.ZP, draw.Src)
+	for x := 20; x < 380; x += 6 {
+		draw.Draw(img, image.Rect(x, 30+x%12, x+3, 66-x%9), image.Black, image.ZP, draw.Src)
+	}
+
+	line := image.Rect(10, 26, 390, 74)
+	if err := applyRedactions(img, []Redaction{{line.Min.X, line.Min.Y, line.Dx(), line.Dy(), "blur"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The line is a single row of samples, so nothing changes within its
+	// height: no part of any letter is left.
+	for x := line.Min.X; x < line.Max.X; x++ {
+		top := img.RGBAAt(x, line.Min.Y)
+		for y := line.Min.Y; y < line.Max.Y; y++ {
+			c := img.RGBAAt(x, y)
+			if d := int(c.R) - int(top.R); !assert.True(t, d >= -1 && d <= 1, "(%d, %d): %v, top %v", x, y, c, top) {
+				return
+			}
+		}
+	}
+}
+
+func TestRedactionBounds(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+
+	// Regions are clipped to the image...
+	assert.NoError(t, applyRedactions(img, []Redaction{{90, 90, 50, 50, "fill"}}))
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, img.At(99, 99))
+
+	// ... but must overlap it.
+	assert.Error(t, applyRedactions(img, []Redaction{{100, 0, 10, 10, "fill"}}))
+}
+
+func TestSanitizeRedactsAfterOrientation(t *testing.T) {
+	f, err := os.Open(path.Join("exif-orientation-examples", "Landscape_6.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	opts := &SanitizeOptions{Redactions: []Redaction{{0, 0, 10, 10, "fill"}}}
+	out, _, err := SanitizeImageFrom(f, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	img, _, err := image.Decode(out)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The top left of the upright image is redacted, whichever corner of the
+	// stored image that was.
+	assert.True(t, img.Bounds().Dx() > img.Bounds().Dy())
+	assert.Equal(t, color.NRGBAModel.Convert(color.Black), color.NRGBAModel.Convert(img.At(5, 5)))
+	assert.NotEqual(t, color.NRGBAModel.Convert(color.Black), color.NRGBAModel.Convert(img.At(15, 15)))
+}
@@ -0,0 +1,185 @@
+package main
+
+// This file contains the code that produces renditions: smaller copies of each
+// upload (thumbnails, and the sizes used in a srcset) that are published
+// alongside the main image.
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RenditionSpec describes one rendition, as given in the config.
+type RenditionSpec struct {
+	Name   string `json:"name"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+
+	// Either "fit", to scale the image down to fit within the size, or
+	// "fill", to scale and crop it to exactly that size.
+	Mode string `json:"mode"`
+
+	// How "fill" renditions are cropped - either "center" or "smart" (see
+	// smartCropRect).
+	Crop string `json:"crop,omitempty"`
+}
+
+// Rendition is an encoded rendition of an image.
+type Rendition struct {
+	Name   string `json:"name"`
+	Mode   string `json:"mode"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Data   []byte `json:"data"`
+}
+
+var (
+	renditionNameRe = regexp.MustCompile(`^[a-z0-9_]+$`)
+	renditionSpecRe = regexp.MustCompile(`^(\d+)(?:x(\d+))?(?:\s+(fit|fill))?(?:\s+crop=(center|smart))?$`)
+)
+
+// Parses the renditions from the config, which look like:
+//
+//	thumb: 200x200 fill
+//	avatar: 128 fill crop=smart
+//	medium: 1024 fit
+//
+// A single number is used for both the width and height, and the mode
+// defaults to "fit".  "fill" renditions are cropped in the center unless
+// "crop=smart" is given.  The renditions are returned sorted by name.
+func parseRenditions(config map[string]string) ([]RenditionSpec, error) {
+	var specs []RenditionSpec
+	for name, spec := range config {
+		if !renditionNameRe.MatchString(name) {
+			return nil, fmt.Errorf("Rendition name '%s' is not valid", name)
+		}
+
+		m := renditionSpecRe.FindStringSubmatch(strings.TrimSpace(spec))
+		if m == nil {
+			return nil, fmt.Errorf("Rendition '%s' has invalid size '%s'", name, spec)
+		}
+
+		width, _ := strconv.Atoi(m[1])
+		height := width
+		if len(m[2]) > 0 {
+			height, _ = strconv.Atoi(m[2])
+		}
+		if width < 1 || height < 1 {
+			return nil, fmt.Errorf("Rendition '%s' has invalid size '%s'", name, spec)
+		}
+
+		mode := m[3]
+		if len(mode) == 0 {
+			mode = "fit"
+		}
+
+		crop := m[4]
+		if len(crop) > 0 && mode != "fill" {
+			return nil, fmt.Errorf("Rendition '%s' can only be cropped in 'fill' mode", name)
+		} else if len(crop) == 0 && mode == "fill" {
+			crop = "center"
+		}
+
+		specs = append(specs, RenditionSpec{name, width, height, mode, crop})
+	}
+
+	sort.Sort(specsByName(specs))
+	return specs, nil
+}
+
+type specsByName []RenditionSpec
+
+func (s specsByName) Len() int           { return len(s) }
+func (s specsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s specsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// Produces each of the renditions in opts from img, encoding them in the same
+// format as the main image was.  JPEG renditions use the same quality as the
+// main image, rather than searching for one again.
+func makeRenditions(img image.Image, source io.ReadSeeker, res *SanitizeResult, opts *SanitizeOptions) ([]Rendition, error) {
+	ropts := *opts
+	if res.Format == "jpeg" {
+		ropts.JPEGMode = "fixed"
+		ropts.JPEGQuality = res.Quality
+	}
+
+	var renditions []Rendition
+	for _, spec := range opts.Renditions {
+		var scaled image.Image
+		switch spec.Mode {
+		case "fit":
+			scaled, _ = fitImage(img, spec.Width, spec.Height)
+		case "fill":
+			// Filling scales up if it has to, so the size is limited
+			// here rather than by the image it's made from.
+			width, height := limitSize(spec.Width, spec.Height, opts.MaxWidth, opts.MaxHeight)
+			scaled = fillImage(img, width, height, spec.Crop, opts.SmartCropSkin)
+		default:
+			return nil, fmt.Errorf("unknown rendition mode: %s", spec.Mode)
+		}
+
+		if opts.Watermark != nil && opts.Watermark.Renditions {
+			var err error
+			if scaled, err = applyWatermark(scaled, opts.Watermark); err != nil {
+				return nil, err
+			}
+		}
+
+		var buf bytes.Buffer
+		rres := *res
+		if err := encodeImage(&buf, scaled, source, &rres, &ropts); err != nil {
+			return nil, err
+		}
+
+		b := scaled.Bounds()
+		renditions = append(renditions, Rendition{
+			Name:   spec.Name,
+			Mode:   spec.Mode,
+			Width:  b.Dx(),
+			Height: b.Dy(),
+			Data:   buf.Bytes(),
+		})
+	}
+
+	return renditions, nil
+}
+
+// Scales a width and height down, keeping their aspect ratio, until they are
+// no larger than maxWidth and maxHeight.  A maximum of 0 means no limit.
+func limitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	if maxWidth > 0 && width > maxWidth {
+		width, height = maxWidth, height*maxWidth/width
+	}
+	if maxHeight > 0 && height > maxHeight {
+		width, height = width*maxHeight/height, maxHeight
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
+
+// Builds a srcset attribute from the URLs of the images at each width.
+// Duplicate widths are only listed once.
+func buildSrcset(urls map[int]string) string {
+	widths := make([]int, 0, len(urls))
+	for w := range urls {
+		widths = append(widths, w)
+	}
+	sort.Ints(widths)
+
+	parts := make([]string, len(widths))
+	for i, w := range widths {
+		parts[i] = fmt.Sprintf("%s %dw", urls[w], w)
+	}
+	return strings.Join(parts, ", ")
+}
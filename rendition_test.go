@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRenditions(t *testing.T) {
+	specs, err := parseRenditions(map[string]string{
+		"thumb":  "200x100 fill",
+		"avatar": "64 fill crop=smart",
+		"medium": "1024 fit",
+		"small":  "640",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []RenditionSpec{
+			{"avatar", 64, 64, "fill", "smart"},
+			{"medium", 1024, 1024, "fit", ""},
+			{"small", 640, 640, "fit", ""},
+			{"thumb", 200, 100, "fill", "center"},
+		}, specs)
+	}
+
+	for _, bad := range []map[string]string{
+		{"Thumb!": "200"},
+		{"thumb": "200x"},
+		{"thumb": "0x200"},
+		{"thumb": "200 stretch"},
+		{"thumb": "200 fit crop=smart"},
+		{"thumb": "200 fill crop=top"},
+	} {
+		_, err := parseRenditions(bad)
+		assert.Error(t, err, "%v", bad)
+	}
+}
+
+func TestMakeRenditions(t *testing.T) {
+	f, err := os.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	opts := &SanitizeOptions{
+		JPEGMode:    "fixed",
+		JPEGQuality: 85,
+		MaxWidth:    400,
+		Renditions: []RenditionSpec{
+			{"small", 300, 300, "fit", ""},
+			{"thumb", 64, 64, "fill", "smart"},
+			{"huge", 10000, 10000, "fit", ""},
+		},
+	}
+	_, res, err := SanitizeImageFrom(f, opts)
+	if !assert.NoError(t, err) || !assert.Len(t, res.Renditions, 3) {
+		return
+	}
+
+	for _, r := range res.Renditions {
+		img, format, err := image.Decode(bytes.NewReader(r.Data))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, "jpeg", format)
+		assert.Equal(t, r.Width, img.Bounds().Dx())
+		assert.Equal(t, r.Height, img.Bounds().Dy())
+	}
+
+	small, thumb, huge := res.Renditions[0], res.Renditions[1], res.Renditions[2]
+	assert.True(t, small.Width <= 300 && small.Height <= 300)
+	assert.True(t, small.Width == 300 || small.Height == 300)
+	assert.Equal(t, 64, thumb.Width)
+	assert.Equal(t, 64, thumb.Height)
+
+	// Renditions are no larger than the maximum size, and are never scaled
+	// up.
+	assert.Equal(t, 400, res.Width)
+	assert.Equal(t, res.Width, huge.Width)
+	assert.Equal(t, res.Height, huge.Height)
+}
+
+func TestRenditionsMaxSize(t *testing.T) {
+	f, err := os.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	opts := &SanitizeOptions{
+		JPEGMode:    "fixed",
+		JPEGQuality: 85,
+		MaxWidth:    500,
+		MaxHeight:   500,
+		Renditions: []RenditionSpec{
+			{"large", 1500, 1500, "fit", ""},
+			{"banner", 1500, 750, "fill", "center"},
+		},
+	}
+	_, res, err := SanitizeImageFrom(f, opts)
+	if !assert.NoError(t, err) || !assert.Len(t, res.Renditions, 2) {
+		return
+	}
+
+	// Renditions bigger than the maximum size are limited to it, like the
+	// main image is.
+	large, banner := res.Renditions[0], res.Renditions[1]
+	assert.Equal(t, res.Width, large.Width)
+	assert.Equal(t, res.Height, large.Height)
+	assert.Equal(t, 500, banner.Width)
+	assert.Equal(t, 250, banner.Height)
+}
+
+func TestLimitSize(t *testing.T) {
+	for _, c := range []struct{ w, h, maxW, maxH, outW, outH int }{
+		{100, 50, 0, 0, 100, 50},
+		{100, 50, 200, 200, 100, 50},
+		{1500, 750, 500, 0, 500, 250},
+		{1500, 750, 0, 300, 600, 300},
+		{1500, 750, 500, 100, 200, 100},
+		{1000, 1, 10, 10, 10, 1},
+	} {
+		w, h := limitSize(c.w, c.h, c.maxW, c.maxH)
+		assert.Equal(t, []int{c.outW, c.outH}, []int{w, h}, "%v", c)
+	}
+}
+
+func TestBuildSrcset(t *testing.T) {
+	assert.Equal(t, "", buildSrcset(nil))
+	assert.Equal(t, "a.jpg 100w, b.jpg 200w, c.jpg 1000w", buildSrcset(map[int]string{
+		1000: "c.jpg",
+		100:  "a.jpg",
+		200:  "b.jpg",
+	}))
+}
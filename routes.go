@@ -1,14 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/mitchellh/goamz/s3"
 	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
 )
 
 func Index(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -22,6 +32,9 @@ func Index(c web.C, w http.ResponseWriter, r *http.Request) {
 func Upload(c web.C, w http.ResponseWriter, r *http.Request) {
 	client := c.Env["client"].(*s3.S3)
 	config := c.Env["config"].(*Config)
+	budget := c.Env["budget"].(*memoryBudget)
+	index := c.Env["index"].(*uploadIndex)
+	received := time.Now().UTC()
 
 	// Store up to 5 MiB in memory
 	err := r.ParseMultipartForm(5 * 1024 * 1024)
@@ -37,79 +50,651 @@ func Upload(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 	defer f.Close()
 
-	// Try decoding the input as an image.
-	imageFormat, ok := checkImage(f)
+	// Try decoding the input as an image.  TIFF is a large and rarely used
+	// format, so unless it's allowed, TIFFs aren't even looked at.
+	if !config.AcceptTIFF && isTIFF(f) {
+		renderError(w, http.StatusUnsupportedMediaType, "unsupported format", "TIFF uploads are not allowed")
+		return
+	}
+	imageConfig, imageFormat, ok := checkImage(f)
 	if !ok {
 		renderError(w, http.StatusBadRequest, "not an image", "input does not appear to be an image")
 		return
 	}
 	contentType := "image/" + imageFormat
 
+	opts, err := sanitizeOptions(r, config)
+	if err != nil {
+		renderError(w, http.StatusBadRequest, err.Error(), "invalid encoding options")
+		return
+	}
+	duplicates, err := duplicateAction(r, config)
+	if err != nil {
+		renderError(w, http.StatusBadRequest, err.Error(), "invalid upload options")
+		return
+	}
+
 	log.WithFields(logrus.Fields{
 		"name":   filename,
 		"size":   size,
 		"format": imageFormat,
+		"width":  imageConfig.Width,
+		"height": imageConfig.Height,
 	}).Info("got upload")
 
-	// If there's an archive bucket, save there.
+	// Wait until there's enough memory to process this image.  If it takes too
+	// long, tell the client to come back later instead of piling up.  Images
+	// that would take more than the whole budget are never processed.
+	needed := estimateImageMemory(imageConfig, opts)
+	if !budget.Fits(needed) {
+		log.WithFields(logrus.Fields{
+			"name":   filename,
+			"width":  imageConfig.Width,
+			"height": imageConfig.Height,
+			"needed": needed,
+		}).Warn("upload is too large to process")
+
+		renderError(w, http.StatusRequestEntityTooLarge, "image too large", "the image is too large to process")
+		return
+	}
+	reserved, ok := budget.Acquire(needed, config.ProcessingWait())
+	if !ok {
+		log.WithFields(logrus.Fields{
+			"name":        filename,
+			"queue_depth": budget.QueueDepth(),
+		}).Warn("processing budget exhausted")
+
+		w.Header().Set("Retry-After", strconv.Itoa(config.ProcessingWaitSeconds))
+		renderError(w, http.StatusServiceUnavailable, "server busy", "too many images being processed, try again later")
+		return
+	}
+	defer budget.Release(reserved)
+
+	// Archive the original and sanitize + publish it at the same time.  Each
+	// side reads the upload through its own SectionReader, so neither needs to
+	// wait for the other to finish and seek back to the start.
+	abort := newAbortSignal()
+	archiveErr := make(chan error, 1)
+	archiveAborted := false
+	archiveKey := newArchiveKey(filename)
 	if len(config.ArchiveBucket) > 0 {
-		b := client.Bucket(config.ArchiveBucket)
-		err = b.PutReader(filename, f, size, contentType, s3.BucketOwnerFull)
+		go func() {
+			err := archiveImage(client.Bucket(config.ArchiveBucket), archiveKey,
+				io.NewSectionReader(f, 0, size), size, contentType, abort)
+			if err != nil {
+				archiveAborted = abort.Abort()
+			}
+			archiveErr <- err
+		}()
+	} else {
+		archiveErr <- nil
+	}
+
+	b := client.Bucket(config.PublicBucket)
+	pub, err := publishImage(b, index, filename, io.NewSectionReader(f, 0, size),
+		imageFormat, opts, config, abort)
+	if err != nil {
+		abort.Abort()
+	} else {
+		defer pub.Release()
+	}
+
+	// Wait for the archive to finish.  Whichever side failed first aborted
+	// the other, so its error is the one to report.
+	aerr := <-archiveErr
+	if err != nil && !archiveAborted {
+		meta := "error saving to public bucket"
+		if serr, ok := err.(*stageError); ok {
+			meta = serr.meta
+		}
+		renderError(w, http.StatusInternalServerError, err.Error(), meta)
+		return
+	}
+
+	// If the archive failed after the public image was uploaded, remove the
+	// public copies again - we never publish an image that we haven't
+	// archived.
+	if aerr != nil {
+		if err == nil {
+			removePublished(b, pub.Keys())
+		}
+		renderError(w, http.StatusInternalServerError, aerr.Error(), "error saving to archive bucket")
+		return
+	}
+
+	// If exactly the same image has been published before, point the client
+	// at that instead, unless it asked for duplicates to be rejected.
+	if pub.Existing != nil {
+		action := "link"
+		if duplicates == "reject" {
+			action = "reject"
+		}
+		renderDuplicate(w, b, filename, action, similarImage{pub.Existing, 0})
+		return
+	}
+
+	// Look for earlier uploads of a similar image.  Unless they're allowed,
+	// we only find out about duplicates once the image has been sanitized, so
+	// the new copy has to be removed again.  Uploads that hide something
+	// aren't looked for at all: a similar earlier upload may well be the
+	// same image without whatever was hidden.
+	var similar []similarImage
+	var deleteToken string
+	if index != nil {
+		if !opts.hidesContent() {
+			similar = index.Similar(pub.Result.PerceptualHash, config.Duplicates.MaxDistance, "")
+		}
+		if len(similar) > 0 && duplicates != "allow" {
+			removePublished(b, pub.Keys())
+			renderDuplicate(w, b, filename, duplicates, similar[0])
+			return
+		}
+
+		uploader, _, _ := r.BasicAuth()
+		token, tokenHash := newDeleteToken()
+		rec := &uploadRecord{
+			ID:              pub.ID,
+			Key:             pub.Name,
+			Format:          pub.Result.Format,
+			Width:           pub.Result.Width,
+			Height:          pub.Result.Height,
+			Size:            pub.Result.Size,
+			Filename:        filename,
+			OriginalFormat:  imageFormat,
+			OriginalSize:    size,
+			Uploader:        uploader,
+			IP:              remoteIP(r),
+			RequestID:       middleware.GetReqID(c),
+			DeleteTokenHash: tokenHash,
+			SHA256:          pub.SHA256,
+			PerceptualHash:  pub.Result.PerceptualHash,
+			Placeholder:     pub.Result.Placeholder,
+			Received:        received,
+			Uploaded:        time.Now().UTC(),
+		}
+		if len(config.ArchiveBucket) > 0 {
+			rec.ArchiveKey = archiveKey
+		}
+		for _, r := range pub.Renditions {
+			rec.Renditions = append(rec.Renditions, renditionRecord{r.Name, r.Key, r.Width, r.Height})
+		}
+		err = index.Add(rec)
 		if err != nil {
-			renderError(w, http.StatusInternalServerError, err.Error(), "error saving to archive bucket")
+			// The image has been published, so there's no sense in failing
+			// the request now.  It just can't be deleted with a token.
+			log.WithFields(logrus.Fields{
+				"err":         err,
+				"public_name": pub.Name,
+			}).Error("could not add upload to index")
+		} else {
+			deleteToken = token
+		}
+	}
+
+	// Get the URL of the uploaded file and return it.
+	publicURL := b.URL(pub.Name)
+
+	log.WithFields(logrus.Fields{
+		"name":       filename,
+		"public_url": publicURL,
+	}).Info("uploaded public image")
+
+	resp := map[string]interface{}{
+		"status":     "ok",
+		"public_url": publicURL,
+		"sha256":     pub.SHA256,
+	}
+	if len(deleteToken) > 0 {
+		resp["delete_token"] = deleteToken
+		resp["delete_url"] = config.BaseURL + "images/" + pub.ID + "?token=" + deleteToken
+	}
+	if pub.Result.Placeholder != nil {
+		resp["placeholder"] = pub.Result.Placeholder
+	}
+	if pub.Result.Format == "jpeg" && (opts.JPEGMode == "max_size" || opts.JPEGMode == "min_ssim") {
+		// The image is published even if its size or similarity target
+		// couldn't be met, so let the client know.
+		resp["target_met"] = pub.Result.TargetMet
+	}
+	if len(similar) > 0 {
+		resp["duplicate_of"] = similarJSON(b, similar[0])
+	}
+	if opts.Faces != nil {
+		faces := pub.Result.Faces
+		if faces == nil {
+			faces = []FaceBox{}
+		}
+		resp["faces"] = faces
+	}
+	if len(pub.Renditions) > 0 {
+		// Only renditions that keep the aspect ratio of the image belong in
+		// its srcset.
+		renditions := make(map[string]interface{})
+		srcset := map[int]string{pub.Result.Width: publicURL}
+		for _, r := range pub.Renditions {
+			url := b.URL(r.Key)
+			renditions[r.Name] = map[string]interface{}{
+				"url":    url,
+				"width":  r.Width,
+				"height": r.Height,
+			}
+			if r.Mode == "fit" {
+				if _, found := srcset[r.Width]; !found {
+					srcset[r.Width] = url
+				}
+			}
+		}
+		resp["renditions"] = renditions
+		resp["srcset"] = buildSrcset(srcset)
+	}
+
+	renderJSON(w, http.StatusOK, resp)
+}
+
+// Responds to an upload that is a near-duplicate of an earlier one, either by
+// rejecting it or by pointing the client at the earlier one.
+func renderDuplicate(w http.ResponseWriter, b *s3.Bucket, filename, action string, dup similarImage) {
+	log.WithFields(logrus.Fields{
+		"name":         filename,
+		"action":       action,
+		"duplicate_of": dup.ID,
+		"distance":     dup.Distance,
+	}).Info("upload is a duplicate")
+
+	if action == "link" {
+		renderJSON(w, http.StatusOK, map[string]interface{}{
+			"status":       "ok",
+			"public_url":   b.URL(dup.Key),
+			"duplicate_of": similarJSON(b, dup),
+		})
+		return
+	}
+
+	renderJSON(w, http.StatusConflict, map[string]interface{}{
+		"status":       "error",
+		"error":        "duplicate image",
+		"meta":         "this image has already been uploaded",
+		"duplicate_of": similarJSON(b, dup),
+	})
+}
+
+func similarJSON(b *s3.Bucket, s similarImage) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         s.ID,
+		"public_url": b.URL(s.Key),
+		"distance":   s.Distance,
+		"uploaded":   s.Uploaded,
+	}
+}
+
+// The most uploads that Similar lists.
+const maxSimilarResults = 100
+
+// Lists the uploads that look like the one with the given ID, closest first.
+// The "max_distance" parameter sets how different (in bits of the perceptual
+// hash) they may be.
+func Similar(c web.C, w http.ResponseWriter, r *http.Request) {
+	client := c.Env["client"].(*s3.S3)
+	config := c.Env["config"].(*Config)
+	index := c.Env["index"].(*uploadIndex)
+
+	id := c.URLParams["id"]
+	rec := index.Get(id)
+	if rec == nil {
+		renderError(w, http.StatusNotFound, errImageNotFound.Error(), "no upload with that ID")
+		return
+	}
+
+	maxDistance := config.Duplicates.MaxDistance
+	if s := r.FormValue("max_distance"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > perceptualHashBits {
+			renderError(w, http.StatusBadRequest, "invalid max_distance",
+				fmt.Sprintf("max_distance must be between 0 and %d", perceptualHashBits))
 			return
 		}
+		maxDistance = n
+	}
 
-		log.WithFields(logrus.Fields{
-			"name":        filename,
-			"archive_url": b.URL(filename),
-		}).Info("uploaded archive image")
+	b := client.Bucket(config.PublicBucket)
+	similar := index.Similar(rec.PerceptualHash, maxDistance, id)
+	if len(similar) > maxSimilarResults {
+		similar = similar[:maxSimilarResults]
+	}
+	list := make([]map[string]interface{}, len(similar))
+	for i, s := range similar {
+		list[i] = similarJSON(b, s)
+	}
 
-		// We need to seek back to the beginning of the file, since the above reads
-		// until EOF
-		_, err = f.Seek(0, 0)
-		if err != nil {
-			renderError(w, http.StatusInternalServerError, err.Error(), "error saving to archive bucket")
+	renderJSON(w, http.StatusOK, map[string]interface{}{
+		"status":          "ok",
+		"id":              id,
+		"perceptual_hash": rec.PerceptualHash,
+		"similar":         list,
+	})
+}
+
+// Describes a published image: what it looks like, where it and its
+// renditions are, and its placeholder.
+func Info(c web.C, w http.ResponseWriter, r *http.Request) {
+	client := c.Env["client"].(*s3.S3)
+	config := c.Env["config"].(*Config)
+	index := c.Env["index"].(*uploadIndex)
+
+	b := client.Bucket(config.PublicBucket)
+	info, err := describeImage(b, index, c.URLParams["id"])
+	if err == errImageNotFound {
+		renderError(w, http.StatusNotFound, err.Error(), nil)
+		return
+	} else if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error(), "error describing image")
+		return
+	}
+
+	renderJSON(w, http.StatusOK, struct {
+		Status string `json:"status"`
+		*imageInfo
+	}{"ok", info})
+}
+
+// Deletes an image and its renditions from the public bucket, and with
+// "archive=true", its original from the archive bucket.  The "token" parameter
+// must be the image's deletion token, unless the request has the upload
+// credentials.  Only admins can delete originals, or images that aren't in
+// the index.
+func DeleteImage(c web.C, w http.ResponseWriter, r *http.Request) {
+	client := c.Env["client"].(*s3.S3)
+	config := c.Env["config"].(*Config)
+	cache := c.Env["cache"].(derivativeCache)
+	index := c.Env["index"].(*uploadIndex)
+
+	id := c.URLParams["id"]
+	if !imageIDRe.MatchString(id) {
+		renderError(w, http.StatusNotFound, errImageNotFound.Error(), nil)
+		return
+	}
+
+	var rec *uploadRecord
+	if index != nil {
+		rec = index.Get(id)
+	}
+	admin := isAdmin(r, config)
+	if !admin && (rec == nil || !rec.CheckDeleteToken(r.FormValue("token"))) {
+		renderError(w, http.StatusForbidden, "invalid deletion token", "the deletion token does not match this image")
+		return
+	}
+
+	archive := false
+	if s := r.FormValue("archive"); len(s) > 0 {
+		var err error
+		if archive, err = strconv.ParseBool(s); err != nil {
+			renderError(w, http.StatusBadRequest, "invalid archive", "archive must be true or false")
 			return
 		}
 	}
+	if archive && !admin {
+		renderError(w, http.StatusForbidden, "not allowed", "only admins can delete archived originals")
+		return
+	}
 
-	// Sanitize the image.
-	// TODO: add support for animated GIFs
-	sanitized, size, err := SanitizeImageFrom(f, config.JPEGCompression)
+	// Uploads from before archive keys were unique were archived under
+	// their filename, which later uploads with the same name overwrote, so
+	// the original may well belong to one of those.
+	if archive && rec != nil && len(rec.ArchiveKey) > 0 && index.ArchiveShared(rec) {
+		renderError(w, http.StatusConflict, "archive shared", "the archived original is shared with other uploads")
+		return
+	}
+
+	// Don't let an upload of the same image be pointed at this one while it's
+	// being deleted.
+	if rec != nil && len(rec.SHA256) > 0 {
+		unlock := index.LockContent(rec.SHA256)
+		defer unlock()
+	}
+
+	// Look in the bucket for what to delete, rather than trusting the record,
+	// so that nothing is left behind.
+	b := client.Bucket(config.PublicBucket)
+	main, renditions, err := listImageKeys(b, id)
 	if err != nil {
-		renderError(w, http.StatusInternalServerError, err.Error(), "error sanitizing image")
+		renderError(w, http.StatusInternalServerError, err.Error(), "error listing public bucket")
+		return
+	}
+	if main == nil && len(renditions) == 0 && rec == nil {
+		renderError(w, http.StatusNotFound, errImageNotFound.Error(), nil)
 		return
 	}
 
-	// Generate a random name for this image.
-	publicName := randString(10) + "." + imageFormat
+	deleted := []string{}
+	if main != nil {
+		deleted = append(deleted, main.Key)
+	}
+	for _, key := range renditions {
+		deleted = append(deleted, key.Key)
+	}
+	for _, key := range deleted {
+		if err := b.Del(key); err != nil {
+			renderError(w, http.StatusInternalServerError, err.Error(), "error deleting from public bucket")
+			return
+		}
+	}
+
+	// Originals can only be found through the index.
+	archiveDeleted := false
+	if archive && rec != nil && len(rec.ArchiveKey) > 0 && len(config.ArchiveBucket) > 0 {
+		if err := client.Bucket(config.ArchiveBucket).Del(rec.ArchiveKey); err != nil {
+			renderError(w, http.StatusInternalServerError, err.Error(), "error deleting from archive bucket")
+			return
+		}
+		archiveDeleted = true
+	}
+
+	if rec != nil {
+		if err := index.Delete(id); err != nil {
+			renderError(w, http.StatusInternalServerError, err.Error(), "error removing image from index")
+			return
+		}
+	}
+
+	// Transforms of it must stop being served too.
+	cache.Purge(id)
 
 	log.WithFields(logrus.Fields{
-		"name":           filename,
-		"sanitized_size": size,
-		"public_name":    publicName,
-	}).Info("image sanitized")
+		"id":              id,
+		"admin":           admin,
+		"deleted":         len(deleted),
+		"archive_deleted": archiveDeleted,
+	}).Info("deleted image")
 
-	// Save to the public bucket.
+	renderJSON(w, http.StatusOK, map[string]interface{}{
+		"status":          "ok",
+		"id":              id,
+		"deleted":         deleted,
+		"archive_deleted": archiveDeleted,
+	})
+}
+
+var (
+	imageIDRe = regexp.MustCompile(`^[0-9A-Za-z]+$`)
+
+	errImageNotFound = errors.New("image not found")
+)
+
+// Serves a public image with a transform applied to it.  The transform must
+// be signed - see SignTransform.
+func ServeTransform(c web.C, w http.ResponseWriter, r *http.Request) {
+	client := c.Env["client"].(*s3.S3)
+	config := c.Env["config"].(*Config)
+	budget := c.Env["budget"].(*memoryBudget)
+	cache := c.Env["cache"].(derivativeCache)
+	index := c.Env["index"].(*uploadIndex)
+
+	id := c.URLParams["id"]
+	transform := c.URLParams["transform"]
+	sig := r.URL.Query().Get("sig")
+
+	if !checkTransformSignature(config.Transforms.Secret, id, transform, sig) {
+		renderError(w, http.StatusForbidden, "invalid signature", "transform signature does not match")
+		return
+	}
+
+	t, err := parseTransform(transform, &config.Transforms)
+	if err != nil {
+		renderError(w, http.StatusBadRequest, err.Error(), "invalid transform")
+		return
+	}
+
+	// The signature is unique to this image and transform, so it makes a
+	// good ETag.
+	etag := `"` + sig + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", config.Transforms.CacheSeconds))
+
+	// Make sure the image still exists before telling the client that its
+	// copy is still good.  Images from before the index was kept are looked
+	// for in the bucket.
 	b := client.Bucket(config.PublicBucket)
-	err = b.PutReader(publicName, sanitized, size, contentType, s3.PublicRead)
+	if r.Header.Get("If-None-Match") == etag {
+		if index == nil || index.Get(id) == nil {
+			if _, err := publicImageKey(b, id); err == errImageNotFound {
+				renderError(w, http.StatusNotFound, err.Error(), nil)
+				return
+			} else if err != nil {
+				renderError(w, http.StatusInternalServerError, err.Error(), "error fetching image")
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Deleting an image purges its transforms from the cache, and stops
+	// any more being cached, so one that's cached still exists.
+	key := id + "/" + transform
+	if cached, ok := cache.Get(key); ok {
+		serveCachedImage(w, cached)
+		return
+	}
+
+	data, err := fetchPublicImage(b, id)
+	if err == errImageNotFound {
+		renderError(w, http.StatusNotFound, err.Error(), nil)
+		return
+	} else if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error(), "error fetching image")
+		return
+	}
+
+	imageConfig, imageFormat, ok := checkImage(bytes.NewReader(data))
+	if !ok {
+		renderError(w, http.StatusInternalServerError, "not an image", "stored image could not be decoded")
+		return
+	}
+
+	needed := estimateImageMemory(imageConfig, nil)
+	if !budget.Fits(needed) {
+		renderError(w, http.StatusInternalServerError, "image too large", "stored image is too large to process")
+		return
+	}
+	reserved, ok := budget.Acquire(needed, config.ProcessingWait())
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(config.ProcessingWaitSeconds))
+		renderError(w, http.StatusServiceUnavailable, "server busy", "too many images being processed, try again later")
+		return
+	}
+	defer budget.Release(reserved)
+
+	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		renderError(w, http.StatusInternalServerError, err.Error(), "error saving to public bucket")
+		renderError(w, http.StatusInternalServerError, err.Error(), "stored image could not be decoded")
 		return
 	}
 
-	// Get the URL of the uploaded file and return it.
-	publicURL := b.URL(publicName)
+	opts := &SanitizeOptions{
+		JPEGMode:    "fixed",
+		JPEGQuality: config.JPEGCompression,
+		GIFDither:   config.GIFDither,
+	}
+	if t.Quality > 0 {
+		opts.JPEGQuality = t.Quality
+	}
+	res := &SanitizeResult{SourceFormat: imageFormat, Format: outputFormat(t.Format, imageFormat)}
+
+	var buf bytes.Buffer
+	err = encodeImage(&buf, t.Apply(img), nil, res, opts)
+	if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error(), "error transforming image")
+		return
+	}
 
 	log.WithFields(logrus.Fields{
-		"name":       filename,
-		"public_url": publicURL,
-	}).Info("uploaded public image")
+		"id":        id,
+		"transform": transform,
+		"size":      buf.Len(),
+	}).Info("transformed image")
 
+	cached := &cachedImage{ContentType: "image/" + res.Format, Data: buf.Bytes()}
+	cache.Put(key, cached)
+	serveCachedImage(w, cached)
+}
+
+func serveCachedImage(w http.ResponseWriter, img *cachedImage) {
+	w.Header().Set("Content-Type", img.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(img.Data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(img.Data)
+}
+
+// Fetches the sanitized image with the given ID from the public bucket.
+func fetchPublicImage(b *s3.Bucket, id string) ([]byte, error) {
+	key, err := publicImageKey(b, id)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := b.GetReader(key)
+	if err != nil {
+		return nil, bucketError(err)
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// Finds the key of the sanitized image with the given ID in the public
+// bucket, returning errImageNotFound if there isn't one.
+func publicImageKey(b *s3.Bucket, id string) (string, error) {
+	if !imageIDRe.MatchString(id) {
+		return "", errImageNotFound
+	}
+
+	// We don't know what format the image was saved as, so look for it.
+	// Renditions are named "ID-NAME.EXT", so they won't match.
+	list, err := b.List(id+".", "", "", 1)
+	if err != nil {
+		return "", err
+	}
+	if len(list.Contents) == 0 {
+		return "", errImageNotFound
+	}
+	return list.Contents[0].Key, nil
+}
+
+// Returns a signed URL for a transform of an image.
+func SignTransform(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(*Config)
+
+	id := c.URLParams["id"]
+	transform := c.URLParams["transform"]
+	if _, err := parseTransform(transform, &config.Transforms); err != nil {
+		renderError(w, http.StatusBadRequest, err.Error(), "invalid transform")
+		return
+	}
+
+	sig := signTransform(config.Transforms.Secret, id, transform)
 	renderJSON(w, http.StatusOK, map[string]interface{}{
-		"status":     "ok",
-		"public_url": publicURL,
+		"status": "ok",
+		"url":    config.BaseURL + "img/" + id + "/" + transform + "?sig=" + sig,
 	})
 }
 
@@ -134,3 +719,240 @@ func extractFile(r *http.Request, name string) (multipart.File, string, int64, e
 
 	return f, file.Filename, size, nil
 }
+
+// Returns the key to archive an upload with the given filename under.  Each
+// upload gets a random prefix, so that uploads with the same name don't
+// overwrite each other's originals.
+func newArchiveKey(filename string) string {
+	return randString(10) + "/" + filename
+}
+
+// Saves the original, unmodified upload to the archive bucket.
+func archiveImage(b *s3.Bucket, key string, r io.Reader, size int64, contentType string, abort *abortSignal) error {
+	err := b.PutReader(key, abort.Reader(r), size, contentType, s3.BucketOwnerFull)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"name":        key,
+		"archive_url": b.URL(key),
+	}).Info("uploaded archive image")
+	return nil
+}
+
+// publishedImage describes an image saved to the public bucket.
+type publishedImage struct {
+	// The ID shared by the image and its renditions, and the key of the
+	// image itself.
+	ID     string
+	Name   string
+	Result *SanitizeResult
+
+	// The SHA-256 of the image, in hex.
+	SHA256 string
+
+	Renditions []publishedRendition
+
+	// If the same image had already been published, the earlier upload.
+	// Nothing is saved in that case.
+	Existing *uploadRecord
+
+	// Releases the image's content in the upload index (see claimContent).
+	unlock func()
+}
+
+type publishedRendition struct {
+	Name          string
+	Mode          string
+	Key           string
+	Width, Height int
+}
+
+// Returns the keys of every object that makes up the image.
+func (p *publishedImage) Keys() []string {
+	if p.Existing != nil {
+		return nil
+	}
+
+	keys := []string{p.Name}
+	for _, r := range p.Renditions {
+		keys = append(keys, r.Key)
+	}
+	return keys
+}
+
+// Returns the metadata headers the image is saved with: its SHA-256 and
+// placeholder.
+func (p *publishedImage) Headers() map[string][]string {
+	headers := map[string][]string{sha256Header: {p.SHA256}}
+	if p.Result.Placeholder != nil {
+		for k, v := range p.Result.Placeholder.Headers() {
+			headers[k] = v
+		}
+	}
+	return headers
+}
+
+// Locks the image's content in the upload index, so that no other upload of
+// the same image can be published until Release is called, and returns the
+// earlier upload of it, if there is one.
+func (p *publishedImage) claimContent(index *uploadIndex) *uploadRecord {
+	if index == nil {
+		return nil
+	}
+	p.unlock = index.LockContent(p.SHA256)
+	return index.GetContent(p.SHA256)
+}
+
+func (p *publishedImage) Release() {
+	if p.unlock != nil {
+		p.unlock()
+		p.unlock = nil
+	}
+}
+
+// Deletes objects from the public bucket, logging (but otherwise ignoring)
+// any errors.
+func removePublished(b *s3.Bucket, keys []string) {
+	for _, key := range keys {
+		if err := b.Del(key); err != nil {
+			log.WithFields(logrus.Fields{
+				"err":         err,
+				"public_name": key,
+			}).Error("could not remove public image")
+		}
+	}
+}
+
+// Content-addressed IDs are this many hex digits of the image's SHA-256.
+const contentIDLength = 32
+
+// Sanitizes the upload and saves the result, along with any renditions, to
+// the public bucket under a random ID (or one derived from its content).  If
+// there is an upload index and the same image has been published before,
+// nothing is saved and the earlier upload is returned in Existing instead.
+// Unless an error is returned, the caller must Release the image once it has
+// been added to the index.  Errors are returned as a *stageError.
+func publishImage(b *s3.Bucket, index *uploadIndex, filename string, r io.ReadSeeker, imageFormat string, opts *SanitizeOptions, config *Config, abort *abortSignal) (*publishedImage, error) {
+	// Generate a random name for this image.
+	pub := &publishedImage{ID: randString(10)}
+	hash := sha256.New()
+
+	// Sanitize the image and save it to the public bucket.
+	// TODO: add support for animated GIFs
+	// Streaming needs to know the name and type of the object before the
+	// image is encoded, which we don't when picking the best format or when
+	// naming it after its content.
+	if config.StreamingUploads && opts.Format != "best" && !config.ContentAddressedKeys {
+		outFormat := outputFormat(opts.Format, imageFormat)
+		pub.Name = pub.ID + "." + outFormat
+
+		w := newS3Writer(b, pub.Name, "image/"+outFormat, s3.PublicRead, abort)
+		res, err := sanitizeImage(io.MultiWriter(w, hash), r, opts, config)
+		if err != nil {
+			w.Abort()
+			w.Close()
+			return nil, &stageError{err, "error sanitizing image"}
+		}
+
+		pub.Result = res
+		pub.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+		w.SetHeaders(pub.Headers())
+		err = w.Close()
+		if err != nil {
+			return nil, &stageError{err, "error saving to public bucket"}
+		}
+
+		// We only know what the image is once it has been uploaded, so a
+		// duplicate has to be removed again.
+		if pub.Existing = pub.claimContent(index); pub.Existing != nil {
+			removePublished(b, []string{pub.Name})
+			return pub, nil
+		}
+	} else {
+		var buf bytes.Buffer
+		res, err := sanitizeImage(io.MultiWriter(&buf, hash), r, opts, config)
+		if err != nil {
+			return nil, &stageError{err, "error sanitizing image"}
+		}
+		pub.Result = res
+		pub.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+		if config.ContentAddressedKeys {
+			pub.ID = pub.SHA256[:contentIDLength]
+		}
+		pub.Name = pub.ID + "." + res.Format
+
+		if pub.Existing = pub.claimContent(index); pub.Existing != nil {
+			return pub, nil
+		}
+
+		headers := pub.Headers()
+		headers["Content-Type"] = []string{"image/" + res.Format}
+		err = b.PutReaderHeader(pub.Name, abort.Reader(&buf), res.Size, headers, s3.PublicRead)
+		if err != nil {
+			pub.Release()
+			return nil, &stageError{err, "error saving to public bucket"}
+		}
+	}
+	res := pub.Result
+
+	// Renditions share the ID of the main image, so they're easy to find.
+	for _, rend := range res.Renditions {
+		key := pub.ID + "-" + rend.Name + "." + res.Format
+		err := b.PutReader(key, abort.Reader(bytes.NewReader(rend.Data)),
+			int64(len(rend.Data)), "image/"+res.Format, s3.PublicRead)
+		if err != nil {
+			removePublished(b, pub.Keys())
+			pub.Release()
+			return nil, &stageError{err, "error saving rendition to public bucket"}
+		}
+
+		pub.Renditions = append(pub.Renditions, publishedRendition{
+			Name:   rend.Name,
+			Mode:   rend.Mode,
+			Key:    key,
+			Width:  rend.Width,
+			Height: rend.Height,
+		})
+	}
+	// The renditions have been uploaded, so don't hold on to their data.
+	res.Renditions = nil
+
+	fields := logrus.Fields{
+		"name":           filename,
+		"format":         res.Format,
+		"sanitized_size": res.Size,
+		"width":          res.Width,
+		"height":         res.Height,
+		"public_name":    pub.Name,
+		"sha256":         pub.SHA256,
+	}
+	if res.Resized {
+		fields["resized"] = true
+	}
+	if len(pub.Renditions) > 0 {
+		fields["renditions"] = len(pub.Renditions)
+	}
+	if opts.Faces != nil {
+		fields["faces"] = len(res.Faces)
+	}
+	fields["perceptual_hash"] = res.PerceptualHash.String()
+	if res.Format == "jpeg" {
+		fields["quality"] = res.Quality
+		switch opts.JPEGMode {
+		case "preserve":
+			fields["estimated_quality"] = res.EstimatedQuality
+		case "max_size", "min_ssim":
+			fields["target_met"] = res.TargetMet
+			if opts.JPEGMode == "min_ssim" {
+				fields["ssim"] = res.SSIM
+			}
+		}
+	}
+	log.WithFields(fields).Info("image sanitized")
+
+	return pub, nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/goamz/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/zenazn/goji/web"
+)
+
+// Returns a valid config for uploading to the "public" test bucket.
+func testConfig(t *testing.T) *Config {
+	config := &Config{PublicBucket: "public"}
+	config.AWSAuth.AccessKey = "access"
+	config.AWSAuth.SecretKey = "secret"
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// Uploads a file through the Upload handler, with the given form fields, and
+// returns the response.
+func testUpload(t *testing.T, b *s3.Bucket, config *Config, index *uploadIndex, filename string, fields map[string]string) (int, map[string]interface{}) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, _ := mw.CreateFormFile("upload", filename)
+	fw.Write(data)
+	mw.Close()
+
+	r, _ := http.NewRequest("POST", "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	Upload(web.C{
+		Env: map[string]interface{}{
+			"client": b.S3,
+			"config": config,
+			"budget": newMemoryBudget(int64(config.ProcessingMemoryMB) * 1024 * 1024),
+			"index":  index,
+		},
+	}, w, r)
+
+	var resp map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp
+}
+
+func TestUploadArchiveError(t *testing.T) {
+	b, quit := testBucket(t)
+	defer quit()
+
+	// The archive bucket doesn't exist, so archiving fails, and publishing
+	// is aborted because of it.
+	config := testConfig(t)
+	config.ArchiveBucket = "missing"
+
+	code, resp := testUpload(t, b, config, nil, "test.jpg", nil)
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Equal(t, "error saving to archive bucket", resp["meta"])
+
+	// Nothing is left in the public bucket.
+	list, err := b.List("", "", "", 10)
+	if assert.NoError(t, err) {
+		assert.Empty(t, list.Contents)
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	b, quit := testBucket(t)
+	defer quit()
+
+	// A PNG whose header says it's 50000x50000, which would take far more
+	// than the budget to decode.
+	var data bytes.Buffer
+	data.WriteString("\x89PNG\r\n\x1a\n")
+	chunk := func(kind string, body []byte) {
+		binary.Write(&data, binary.BigEndian, uint32(len(body)))
+		crc := crc32.NewIEEE()
+		crc.Write([]byte(kind))
+		crc.Write(body)
+		data.WriteString(kind)
+		data.Write(body)
+		binary.Write(&data, binary.BigEndian, crc.Sum32())
+	}
+	chunk("IHDR", []byte{0, 0, 0xc3, 0x50, 0, 0, 0xc3, 0x50, 8, 0, 0, 0, 0})
+	chunk("IEND", nil)
+
+	f, err := ioutil.TempFile("", "imagehost-bomb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(data.Bytes())
+	f.Close()
+
+	config := testConfig(t)
+	config.ProcessingMemoryMB = 64
+	code, resp := testUpload(t, b, config, nil, f.Name(), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+	assert.Equal(t, "image too large", resp["error"])
+
+	// Nothing was published.
+	list, err := b.List("", "", "", 10)
+	if assert.NoError(t, err) {
+		assert.Empty(t, list.Contents)
+	}
+}
+
+func TestUploadArchiveKey(t *testing.T) {
+	b, quit := testBucket(t)
+	defer quit()
+
+	archive := b.S3.Bucket("archive")
+	if err := archive.PutBucket(s3.Private); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "imagehost-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index, err := openUploadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	// Uploads with the same name are archived separately, and each record
+	// points at its own original.
+	config := testConfig(t)
+	config.ArchiveBucket = "archive"
+	config.RequestOptions.MaxSize = true
+	var keys []string
+	for i := 0; i < 2; i++ {
+		code, resp := testUpload(t, b, config, index, "test.jpg", map[string]string{"max_width": strconv.Itoa(400 + i)})
+		if !assert.Equal(t, http.StatusOK, code) {
+			return
+		}
+		rec := index.Get(strings.TrimSuffix(path.Base(resp["public_url"].(string)), ".jpeg"))
+		if assert.NotNil(t, rec) {
+			assert.True(t, strings.HasSuffix(rec.ArchiveKey, "/test.jpg"), rec.ArchiveKey)
+			keys = append(keys, rec.ArchiveKey)
+		}
+	}
+	if assert.Len(t, keys, 2) {
+		assert.NotEqual(t, keys[0], keys[1])
+	}
+
+	list, err := archive.List("", "", "", 10)
+	if assert.NoError(t, err) {
+		assert.Len(t, list.Contents, 2)
+	}
+}
+
+func TestUploadTIFF(t *testing.T) {
+	b, quit := testBucket(t)
+	defer quit()
+
+	// TIFFs are refused unless they're allowed...
+	config := testConfig(t)
+	code, resp := testUpload(t, b, config, nil, "exif-orientation-examples/Landscape_1.tiff", nil)
+	assert.Equal(t, http.StatusUnsupportedMediaType, code)
+	assert.Equal(t, "unsupported format", resp["error"])
+
+	// ... and then published as PNG, whether streamed or not.
+	config.AcceptTIFF = true
+	for _, streaming := range []bool{false, true} {
+		config.StreamingUploads = streaming
+		code, resp = testUpload(t, b, config, nil, "exif-orientation-examples/Landscape_1.tiff", nil)
+		if assert.Equal(t, http.StatusOK, code, "streaming: %v", streaming) {
+			assert.True(t, strings.HasSuffix(resp["public_url"].(string), ".png"), "%v", resp["public_url"])
+		}
+	}
+}
+
+func TestUploadJPEGTarget(t *testing.T) {
+	b, quit := testBucket(t)
+	defer quit()
+
+	config := testConfig(t)
+	config.JPEGMode = "max_size"
+	for _, maxBytes := range []int64{100, 1 << 20} {
+		config.JPEGMaxBytes = maxBytes
+		code, resp := testUpload(t, b, config, nil, "test.jpg", nil)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, maxBytes > 100, resp["target_met"], "%d bytes", maxBytes)
+	}
+
+	// Nothing is said about targets that weren't asked for.
+	config.JPEGMode = "fixed"
+	_, resp := testUpload(t, b, config, nil, "test.jpg", nil)
+	_, found := resp["target_met"]
+	assert.False(t, found)
+}
+
+func TestUploadMetadata(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		b, quit := testBucket(t)
+
+		config := testConfig(t)
+		config.StreamingUploads = streaming
+		code, resp := testUpload(t, b, config, nil, "test.jpg", nil)
+		if !assert.Equal(t, http.StatusOK, code) {
+			quit()
+			continue
+		}
+
+		// The image is saved with its hash and placeholder, whether it was
+		// streamed or not.
+		list, err := b.List("", "", "", 10)
+		if assert.NoError(t, err) && assert.Len(t, list.Contents, 1) {
+			head, err := b.Head(list.Contents[0].Key)
+			if assert.NoError(t, err) {
+				head.Body.Close()
+				assert.Equal(t, "image/jpeg", head.Header.Get("Content-Type"))
+				assert.Equal(t, resp["sha256"], head.Header.Get(sha256Header), "streaming: %v", streaming)
+				if p := placeholderFromHeaders(head.Header); assert.NotNil(t, p, "streaming: %v", streaming) {
+					assert.Equal(t, resp["placeholder"].(map[string]interface{})["blurhash"], p.BlurHash)
+				}
+			}
+		}
+		quit()
+	}
+}
+
+func TestUploadSimilarHidden(t *testing.T) {
+	b, quit := testBucket(t)
+	defer quit()
+
+	dir, err := ioutil.TempDir("", "imagehost-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index, err := openUploadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	config := testConfig(t)
+	config.Duplicates.Action = "link"
+	config.RequestOptions.Redact = true
+	config.RequestOptions.MaxSize = true
+
+	code, first := testUpload(t, b, config, index, "test.jpg", nil)
+	if !assert.Equal(t, http.StatusOK, code) {
+		return
+	}
+
+	// A slightly smaller copy is linked to the first upload...
+	code, resp := testUpload(t, b, config, index, "test.jpg", map[string]string{"max_width": "400"})
+	if assert.Equal(t, http.StatusOK, code) {
+		assert.Equal(t, first["public_url"], resp["public_url"])
+	}
+
+	// ... but one with something redacted is published by itself, or the
+	// link would give away what was redacted.
+	code, resp = testUpload(t, b, config, index, "test.jpg", map[string]string{"redact": "0,0,100,100,fill"})
+	if assert.Equal(t, http.StatusOK, code) {
+		assert.NotEqual(t, first["public_url"], resp["public_url"])
+		_, found := resp["duplicate_of"]
+		assert.False(t, found)
+	}
+}
+
+func TestServeTransformNotModified(t *testing.T) {
+	b, quit := testBucket(t)
+	defer quit()
+
+	config := testConfig(t)
+	config.Transforms.Secret = "0123456789abcdef0123"
+	putPNG(t, b, "abc123.png", 40, 30, nil)
+
+	// A transform of a deleted image that was cached anyway doesn't count.
+	cache := newMemoryCache(1 << 20)
+	cache.Put("def456/20x20", &cachedImage{ContentType: "image/png", Data: []byte("stale")})
+
+	serve := func(id string) int {
+		sig := signTransform(config.Transforms.Secret, id, "20x20")
+		r, _ := http.NewRequest("GET", "/t/"+id+"/20x20?sig="+sig, nil)
+		r.Header.Set("If-None-Match", `"`+sig+`"`)
+		w := httptest.NewRecorder()
+		ServeTransform(web.C{
+			URLParams: map[string]string{"id": id, "transform": "20x20"},
+			Env: map[string]interface{}{
+				"client": b.S3,
+				"config": config,
+				"budget": newMemoryBudget(0),
+				"cache":  cache,
+				"index":  (*uploadIndex)(nil),
+			},
+		}, w, r)
+		return w.Code
+	}
+
+	// The client's copy is only still good if the image still exists.
+	assert.Equal(t, http.StatusNotModified, serve("abc123"))
+	assert.Equal(t, http.StatusNotFound, serve("def456"))
+}
@@ -0,0 +1,247 @@
+package main
+
+// This file contains an io.WriteCloser that streams data into an S3 object
+// using a multipart upload, so that the whole object never has to be held in
+// memory at once.
+
+import (
+	"bytes"
+	"net/url"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/oxtoacart/bpool"
+)
+
+const (
+	// S3 requires every part of a multipart upload except the last to be at
+	// least 5 MiB.
+	partSize = 5 * 1024 * 1024
+
+	// Number of part buffers kept around between requests.
+	partPoolSize = 8
+)
+
+var partPool = bpool.NewBytePool(partPoolSize, partSize)
+
+// uploadedPart is the result of uploading a single part in the background.
+type uploadedPart struct {
+	part s3.Part
+	err  error
+}
+
+// s3Writer uploads everything written to it to an S3 object.  Data is
+// collected into part-sized buffers; once the first buffer fills up a
+// multipart upload is started, and each full buffer is uploaded in the
+// background while the next one is being filled.  Objects smaller than a
+// single part are sent with a plain PUT when the writer is closed.
+type s3Writer struct {
+	bucket      *s3.Bucket
+	key         string
+	contentType string
+	perm        s3.ACL
+	abort       *abortSignal
+
+	// Extra headers for the object, such as metadata, which often aren't
+	// known until everything has been written.  See SetHeaders.
+	headers map[string][]string
+
+	buf     []byte
+	n       int
+	written int64
+
+	multi   *s3.Multi
+	parts   []s3.Part
+	pending chan uploadedPart
+	err     error
+}
+
+func newS3Writer(b *s3.Bucket, key, contentType string, perm s3.ACL, abort *abortSignal) *s3Writer {
+	return &s3Writer{
+		bucket:      b,
+		key:         key,
+		contentType: contentType,
+		perm:        perm,
+		abort:       abort,
+		buf:         partPool.Get(),
+	}
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.abort.Aborted() {
+		w.err = errAborted
+		return 0, w.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		c := copy(w.buf[w.n:], p)
+		w.n += c
+		written += c
+		p = p[c:]
+
+		if w.n == len(w.buf) {
+			if err := w.flushPart(); err != nil {
+				w.err = err
+				return written, err
+			}
+		}
+	}
+
+	w.written += int64(written)
+	return written, nil
+}
+
+// SetHeaders sets extra headers for the object, which can be done any time
+// before it is closed.
+func (w *s3Writer) SetHeaders(headers map[string][]string) {
+	w.headers = headers
+}
+
+// Returns all the headers the object is stored with.
+func (w *s3Writer) objectHeaders() map[string][]string {
+	headers := map[string][]string{"Content-Type": {w.contentType}}
+	for k, v := range w.headers {
+		headers[k] = v
+	}
+	return headers
+}
+
+// Size returns the number of bytes written so far.
+func (w *s3Writer) Size() int64 {
+	return w.written
+}
+
+// flushPart starts uploading the current buffer as the next part, and swaps
+// in a fresh buffer to write into.  Only one part is uploaded at a time, so
+// this waits for the previous part to finish first.
+func (w *s3Writer) flushPart() error {
+	if w.multi == nil {
+		multi, err := w.bucket.InitMulti(w.key, w.contentType, w.perm)
+		if err != nil {
+			return err
+		}
+		w.multi = multi
+	}
+
+	if err := w.waitPart(); err != nil {
+		return err
+	}
+
+	multi, buf, n, num := w.multi, w.buf, w.n, len(w.parts)+1
+	w.pending = make(chan uploadedPart, 1)
+	go func(pending chan<- uploadedPart) {
+		part, err := multi.PutPart(num, bytes.NewReader(buf[:n]))
+		partPool.Put(buf)
+		pending <- uploadedPart{part, err}
+	}(w.pending)
+
+	w.buf = partPool.Get()
+	w.n = 0
+	return nil
+}
+
+// waitPart waits for the part currently being uploaded, if any.
+func (w *s3Writer) waitPart() error {
+	if w.pending == nil {
+		return nil
+	}
+
+	res := <-w.pending
+	w.pending = nil
+	if res.err != nil {
+		return res.err
+	}
+	w.parts = append(w.parts, res.part)
+	return nil
+}
+
+// Close finishes the upload.  If anything went wrong while writing, the
+// upload is aborted instead and the original error is returned.
+func (w *s3Writer) Close() error {
+	defer w.release()
+
+	if w.err == nil && w.abort.Aborted() {
+		w.err = errAborted
+	}
+	if w.err != nil {
+		w.Abort()
+		return w.err
+	}
+
+	// Small enough to fit in a single part - just PUT it.
+	if w.multi == nil {
+		return w.bucket.PutReaderHeader(w.key, w.abort.Reader(bytes.NewReader(w.buf[:w.n])),
+			int64(w.n), w.objectHeaders(), w.perm)
+	}
+
+	// Upload whatever is left as the final part.
+	if w.n > 0 {
+		if err := w.flushPart(); err != nil {
+			w.err = err
+			w.Abort()
+			return err
+		}
+	}
+	if err := w.waitPart(); err != nil {
+		w.err = err
+		w.Abort()
+		return err
+	}
+
+	if err := w.multi.Complete(w.parts); err != nil {
+		w.err = err
+		w.Abort()
+		return err
+	}
+
+	// The upload was started before the headers were known, so they have to
+	// be added now.  The object is complete either way, so this isn't
+	// worth failing over.
+	if len(w.headers) > 0 {
+		if err := w.replaceHeaders(); err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err,
+				"key": w.key,
+			}).Warn("could not set headers of multipart upload")
+		}
+	}
+	return nil
+}
+
+// Replaces the headers of the uploaded object by copying it onto itself,
+// which S3 does without sending the data again.
+func (w *s3Writer) replaceHeaders() error {
+	headers := w.objectHeaders()
+	source := &url.URL{Path: "/" + w.bucket.Name + "/" + w.key}
+	headers["x-amz-copy-source"] = []string{source.EscapedPath()}
+	headers["x-amz-metadata-directive"] = []string{"REPLACE"}
+	return w.bucket.PutHeader(w.key, nil, headers, w.perm)
+}
+
+// Abort cancels the upload, discarding any parts that were sent.
+func (w *s3Writer) Abort() {
+	if w.err == nil {
+		w.err = errAborted
+	}
+
+	// Don't abort while a part is still in flight, or it may be left behind.
+	w.waitPart()
+
+	if w.multi != nil {
+		if err := w.multi.Abort(); err != nil {
+			log.WithField("err", err).Warn("could not abort multipart upload")
+		}
+		w.multi = nil
+	}
+}
+
+func (w *s3Writer) release() {
+	if w.buf != nil {
+		partPool.Put(w.buf)
+		w.buf = nil
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+// This file contains support for sanitizing images in a separate process.
+// Image decoders are the code most exposed to hostile input, so when the
+// sandbox is enabled we re-execute our own binary as a child that does
+// nothing but sanitize a single image: a JSON header and the original are
+// written to its stdin, and the sanitized image is read back from its stdout.
+// A JSON-encoded SanitizeResult is then sent back on file descriptor 3.
+// The child runs with an empty environment and resource limits, so a crash or
+// a pathological image only fails that one upload.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// If this environment variable is set, we run as a sandboxed sanitizer instead
+// of as a server.
+const sandboxEnvVar = "IMAGEHOST_SANITIZER"
+
+// sandboxHeader is sent to the child as a single line of JSON, before the
+// image itself.
+type sandboxHeader struct {
+	MemoryMB   int              `json:"memory_mb"`
+	CPUSeconds int              `json:"cpu_seconds"`
+	Options    *SanitizeOptions `json:"options"`
+}
+
+// Sanitizes an image, either in this process or in a sandboxed child process,
+// depending on the configuration.
+func sanitizeImage(w io.Writer, r io.ReadSeeker, opts *SanitizeOptions, config *Config) (*SanitizeResult, error) {
+	if !config.Sandbox.Enabled {
+		return SanitizeImageTo(w, r, opts)
+	}
+	return sanitizeInSandbox(w, r, opts, config)
+}
+
+// Runs SanitizeImageTo in a child process.
+func sanitizeInSandbox(w io.Writer, r io.Reader, opts *SanitizeOptions, config *Config) (*SanitizeResult, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("could not find executable for sandbox: %s", err)
+	}
+
+	header, err := json.Marshal(&sandboxHeader{
+		MemoryMB:   config.Sandbox.MemoryMB,
+		CPUSeconds: config.Sandbox.CPUSeconds,
+		Options:    opts,
+	})
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, '\n')
+
+	resultR, resultW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer resultR.Close()
+
+	var stderr, result limitedBuffer
+	stderr.limit = 64 * 1024
+
+	// The result includes any renditions, so it can be as large as anything
+	// the child could have held in memory.
+	result.limit = config.Sandbox.MemoryMB * 1024 * 1024
+
+	cmd := exec.Command(exe)
+	cmd.Env = []string{sandboxEnvVar + "=1"}
+	cmd.Dir = os.TempDir()
+	cmd.Stdin = io.MultiReader(bytes.NewReader(header), r)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	cmd.ExtraFiles = []*os.File{resultW}
+
+	err = cmd.Start()
+	resultW.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not start sandbox: %s", err)
+	}
+
+	resultDone := make(chan struct{})
+	go func() {
+		io.Copy(&result, resultR)
+		close(resultDone)
+	}()
+
+	// Kill the child if it takes too long, regardless of how much CPU time it
+	// has actually used.
+	var timedOut bool
+	var mu sync.Mutex
+	timer := time.AfterFunc(config.Sandbox.Timeout(), func() {
+		mu.Lock()
+		timedOut = true
+		mu.Unlock()
+		cmd.Process.Kill()
+	})
+
+	err = cmd.Wait()
+	timer.Stop()
+	<-resultDone
+
+	// Pass along whatever the child logged.
+	if stderr.Len() > 0 {
+		log.Out.Write(stderr.Bytes())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if timedOut && err != nil {
+		return nil, fmt.Errorf("sandboxed sanitizer timed out after %s", config.Sandbox.Timeout())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sandboxed sanitizer failed: %s", err)
+	}
+
+	var res SanitizeResult
+	if err = json.Unmarshal(result.Bytes(), &res); err != nil {
+		return nil, fmt.Errorf("could not decode sandbox result: %s", err)
+	}
+	return &res, nil
+}
+
+// Returns whether we were started as a sandboxed sanitizer.
+func isSandboxChild() bool {
+	return os.Getenv(sandboxEnvVar) == "1"
+}
+
+// The entry point for the sandboxed child.  Returns the exit code.
+func runSandboxChild() int {
+	// Stdout is reserved for the sanitized image, so log to stderr instead.
+	log.Out = os.Stderr
+
+	in := bufio.NewReader(os.Stdin)
+
+	line, err := in.ReadBytes('\n')
+	if err != nil {
+		log.WithField("err", err).Error("sandbox: could not read header")
+		return 1
+	}
+
+	var header sandboxHeader
+	if err = json.Unmarshal(line, &header); err != nil || header.Options == nil {
+		log.WithField("err", err).Error("sandbox: could not decode header")
+		return 1
+	}
+
+	// Limit ourselves before we touch the image.
+	if err = setSandboxLimits(header.MemoryMB, header.CPUSeconds); err != nil {
+		log.WithField("err", err).Error("sandbox: could not set resource limits")
+		return 1
+	}
+
+	input, err := ioutil.ReadAll(in)
+	if err != nil {
+		log.WithField("err", err).Error("sandbox: could not read image")
+		return 1
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	res, err := SanitizeImageTo(out, bytes.NewReader(input), header.Options)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		log.WithField("err", err).Error("sandbox: could not sanitize image")
+		return 1
+	}
+
+	resultFile := os.NewFile(3, "result")
+	if err = json.NewEncoder(resultFile).Encode(res); err != nil {
+		log.WithField("err", err).Error("sandbox: could not send result")
+		return 1
+	}
+
+	return 0
+}
+
+// limitedBuffer is a bytes.Buffer that silently drops anything written past
+// its limit, so that a misbehaving child can't make us use lots of memory.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.limit - b.Len(); room < len(p) {
+		if room < 0 {
+			room = 0
+		}
+		p = p[:room]
+	}
+	b.Buffer.Write(p)
+	return n, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The sandbox re-executes the current binary, which for tests is the test
+// binary, so it needs to be able to act as the child too.
+func TestMain(m *testing.M) {
+	if isSandboxChild() {
+		os.Exit(runSandboxChild())
+	}
+	os.Exit(m.Run())
+}
+
+func sandboxTestConfig() *Config {
+	config := &Config{}
+	config.Sandbox = SandboxConfig{
+		Enabled:        true,
+		MemoryMB:       1024,
+		CPUSeconds:     30,
+		TimeoutSeconds: 60,
+	}
+	return config
+}
+
+func TestSandboxSanitize(t *testing.T) {
+	f, err := os.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	res, err := sanitizeImage(&buf, f, &SanitizeOptions{JPEGQuality: 80}, sandboxTestConfig())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "jpeg", res.Format)
+	assert.Equal(t, int64(buf.Len()), res.Size)
+
+	_, format, err := image.Decode(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "jpeg", format)
+}
+
+func TestSandboxFailure(t *testing.T) {
+	config := sandboxTestConfig()
+
+	// Not an image.
+	var buf bytes.Buffer
+	_, err := sanitizeImage(&buf, bytes.NewReader([]byte("garbage")), &SanitizeOptions{}, config)
+	assert.Error(t, err)
+
+	// The child can't possibly run in this little memory, so it will crash.
+	f, err := os.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	config.Sandbox.MemoryMB = 1
+	_, err = sanitizeImage(&buf, f, &SanitizeOptions{JPEGQuality: 80}, config)
+	assert.Error(t, err)
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// Applies resource limits to the current process.  A limit of 0 leaves that
+// resource unlimited.
+func setSandboxLimits(memoryMB, cpuSeconds int) error {
+	// We never need to create files.
+	limits := map[int]uint64{
+		syscall.RLIMIT_FSIZE: 0,
+	}
+	if memoryMB > 0 {
+		limits[syscall.RLIMIT_DATA] = uint64(memoryMB) * 1024 * 1024
+	}
+	if cpuSeconds > 0 {
+		limits[syscall.RLIMIT_CPU] = uint64(cpuSeconds)
+	}
+
+	for resource, value := range limits {
+		rlim := syscall.Rlimit{Cur: value, Max: value}
+		if err := syscall.Setrlimit(resource, &rlim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
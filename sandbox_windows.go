@@ -0,0 +1,10 @@
+package main
+
+import (
+	"errors"
+)
+
+// Resource limits aren't supported on Windows, so the sandbox can't be used.
+func setSandboxLimits(memoryMB, cpuSeconds int) error {
+	return errors.New("resource limits are not supported on Windows")
+}
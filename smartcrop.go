@@ -0,0 +1,193 @@
+package main
+
+// This file contains "smart" cropping, which picks the most interesting part
+// of an image to keep when cropping it to a different aspect ratio, rather
+// than always keeping the middle.  How interesting an area is depends on how
+// much detail (edge energy) it has and, optionally, how much of it looks like
+// skin - so that crops of people keep their faces.
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Images are scaled down to at most this size before being analyzed, which is
+// plenty to find the interesting areas and much faster than the full image.
+const smartCropAnalysisSize = 256
+
+// How much a skin-colored pixel adds to the score, relative to the strongest
+// edge.
+const smartCropSkinWeight = 0.5
+
+// Crops img to the given aspect ratio, keeping either the middle ("center")
+// or the most interesting area ("smart").
+func cropToAspect(img image.Image, aspectW, aspectH int, strategy string, skin bool) image.Image {
+	return cropToRect(img, aspectCropRect(img, aspectW, aspectH, strategy, skin))
+}
+
+// Returns the rectangle that cropToAspect crops img to.
+func aspectCropRect(img image.Image, aspectW, aspectH int, strategy string, skin bool) image.Rectangle {
+	if strategy == "smart" {
+		return smartCropRect(img, aspectW, aspectH, skin)
+	}
+	return centerCropRect(img.Bounds(), aspectW, aspectH)
+}
+
+func cropToRect(img image.Image, rect image.Rectangle) image.Image {
+	if rect == img.Bounds() {
+		return img
+	}
+	return imaging.Crop(img, rect)
+}
+
+// Crops and scales img to exactly width x height.
+func fillImage(img image.Image, width, height int, strategy string, skin bool) image.Image {
+	if strategy != "smart" {
+		return imaging.Thumbnail(img, width, height, imaging.Lanczos)
+	}
+
+	cropped := cropToAspect(img, width, height, strategy, skin)
+	return imaging.Resize(cropped, width, height, imaging.Lanczos)
+}
+
+// Returns the size of the largest window of the given aspect ratio that fits
+// in a w x h image.
+func cropWindow(w, h, aspectW, aspectH int) (int, int) {
+	if w*aspectH > h*aspectW {
+		// The image is wider than the aspect ratio.
+		cw := h * aspectW / aspectH
+		if cw < 1 {
+			cw = 1
+		}
+		return cw, h
+	}
+
+	ch := w * aspectH / aspectW
+	if ch < 1 {
+		ch = 1
+	}
+	return w, ch
+}
+
+// Returns the largest rectangle of the given aspect ratio in the middle of b.
+func centerCropRect(b image.Rectangle, aspectW, aspectH int) image.Rectangle {
+	cw, ch := cropWindow(b.Dx(), b.Dy(), aspectW, aspectH)
+	x := b.Min.X + (b.Dx()-cw)/2
+	y := b.Min.Y + (b.Dy()-ch)/2
+	return image.Rect(x, y, x+cw, y+ch)
+}
+
+// Returns the largest rectangle of the given aspect ratio in img that has the
+// most interesting content in it.
+func smartCropRect(img image.Image, aspectW, aspectH int, skin bool) image.Rectangle {
+	b := img.Bounds()
+	cw, ch := cropWindow(b.Dx(), b.Dy(), aspectW, aspectH)
+	if cw == b.Dx() && ch == b.Dy() {
+		return b
+	}
+
+	// Work out the interest of each pixel in a small copy of the image.
+	small := imaging.Fit(img, smartCropAnalysisSize, smartCropAnalysisSize, imaging.Box)
+	sw, sh := small.Bounds().Dx(), small.Bounds().Dy()
+	scale := float64(sw) / float64(b.Dx())
+	energy := interestMap(small, skin)
+
+	// A summed-area table makes the total interest of any window cheap to
+	// find.
+	sum := make([]float64, (sw+1)*(sh+1))
+	for y := 0; y < sh; y++ {
+		var row float64
+		for x := 0; x < sw; x++ {
+			row += energy[y*sw+x]
+			sum[(y+1)*(sw+1)+x+1] = sum[y*(sw+1)+x+1] + row
+		}
+	}
+	area := func(x0, y0, x1, y1 int) float64 {
+		return sum[y1*(sw+1)+x1] - sum[y0*(sw+1)+x1] - sum[y1*(sw+1)+x0] + sum[y0*(sw+1)+x0]
+	}
+
+	// The window is as large as it can be, so it can only slide along one
+	// axis.  Try every position along that axis in the small image.
+	scw := clampInt(int(float64(cw)*scale+0.5), 1, sw)
+	sch := clampInt(int(float64(ch)*scale+0.5), 1, sh)
+	horizontal := cw < b.Dx()
+	positions := sh - sch
+	if horizontal {
+		positions = sw - scw
+	}
+
+	best, bestScore := positions/2, math.Inf(-1)
+	for p := 0; p <= positions; p++ {
+		var score float64
+		if horizontal {
+			score = area(p, 0, p+scw, sch)
+		} else {
+			score = area(0, p, scw, p+sch)
+		}
+
+		// Prefer windows near the middle when there's little to choose
+		// between them.
+		if positions > 0 {
+			offCenter := math.Abs(float64(p)-float64(positions)/2) / float64(positions)
+			score *= 1 - 0.1*offCenter
+		}
+
+		if score > bestScore {
+			best, bestScore = p, score
+		}
+	}
+
+	// Scale the position back up to the full image.
+	offset := int(float64(best)/scale + 0.5)
+	if horizontal {
+		x := b.Min.X + clampInt(offset, 0, b.Dx()-cw)
+		return image.Rect(x, b.Min.Y, x+cw, b.Min.Y+ch)
+	}
+	y := b.Min.Y + clampInt(offset, 0, b.Dy()-ch)
+	return image.Rect(b.Min.X, y, b.Min.X+cw, y+ch)
+}
+
+// Returns how interesting each pixel of img is: the strength of the edge
+// there, plus a bonus for skin tones if skin is true.
+func interestMap(img *image.NRGBA, skin bool) []float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	luma := make([]float64, w*h)
+	energy := make([]float64, w*h)
+
+	for y := 0; y < h; y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < w; x++ {
+			r, g, b := row[4*x], row[4*x+1], row[4*x+2]
+			luma[y*w+x] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			if skin && isSkinTone(r, g, b) {
+				energy[y*w+x] = smartCropSkinWeight * 255
+			}
+		}
+	}
+
+	// Edge energy is the magnitude of the Laplacian of the luma.
+	at := func(x, y int) float64 {
+		return luma[clampInt(y, 0, h-1)*w+clampInt(x, 0, w-1)]
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			lap := 4*at(x, y) - at(x-1, y) - at(x+1, y) - at(x, y-1) - at(x, y+1)
+			energy[y*w+x] += math.Min(math.Abs(lap), 255)
+		}
+	}
+
+	return energy
+}
+
+// A simple rule for whether an (RGB) color looks like skin, from Kovac et
+// al., "Human Skin Colour Clustering for Face Detection" (2003).
+func isSkinTone(r, g, b uint8) bool {
+	max := math.Max(float64(r), math.Max(float64(g), float64(b)))
+	min := math.Min(float64(r), math.Min(float64(g), float64(b)))
+	return r > 95 && g > 40 && b > 20 &&
+		max-min > 15 &&
+		math.Abs(float64(r)-float64(g)) > 15 &&
+		r > g && r > b
+}
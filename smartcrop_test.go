@@ -0,0 +1,107 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns a flat gray image with random noise (i.e. lots of detail) in r.
+func noisyImage(w, h int, r image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{0x80}), image.ZP, draw.Src)
+
+	rng := rand.New(rand.NewSource(1))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			v := uint8(rng.Intn(256))
+			img.Set(x, y, color.RGBA{v, v, v, 0xff})
+		}
+	}
+	return img
+}
+
+func TestCropWindow(t *testing.T) {
+	w, h := cropWindow(400, 200, 1, 1)
+	assert.Equal(t, 200, w)
+	assert.Equal(t, 200, h)
+
+	w, h = cropWindow(400, 200, 16, 9)
+	assert.Equal(t, 355, w)
+	assert.Equal(t, 200, h)
+
+	w, h = cropWindow(400, 200, 1, 2)
+	assert.Equal(t, 100, w)
+	assert.Equal(t, 200, h)
+
+	w, h = cropWindow(200, 400, 4, 3)
+	assert.Equal(t, 200, w)
+	assert.Equal(t, 150, h)
+}
+
+func TestSmartCrop(t *testing.T) {
+	// A tall image with all its detail at the top, like a portrait.
+	img := noisyImage(300, 900, image.Rect(50, 20, 250, 220))
+
+	center := centerCropRect(img.Bounds(), 1, 1)
+	assert.Equal(t, image.Rect(0, 300, 300, 600), center)
+
+	smart := smartCropRect(img, 1, 1, false)
+	assert.Equal(t, 300, smart.Dx())
+	assert.Equal(t, 300, smart.Dy())
+	assert.True(t, smart.Min.Y <= 20 && smart.Max.Y >= 220, "crop %v misses the detail", smart)
+
+	// The same, sideways, with an offset origin.
+	wide := noisyImage(900, 300, image.Rect(650, 50, 880, 250))
+	sub := wide.SubImage(image.Rect(10, 0, 900, 300))
+	smart = smartCropRect(sub, 1, 1, false)
+	assert.Equal(t, image.Pt(300, 300), smart.Size())
+	assert.True(t, smart.In(sub.Bounds()))
+	assert.True(t, smart.Min.X <= 650 && smart.Max.X >= 880, "crop %v misses the detail", smart)
+
+	// Images that already have the right aspect ratio aren't cropped.
+	assert.Equal(t, img.Bounds(), smartCropRect(img, 1, 3, false))
+}
+
+func TestSmartCropSkin(t *testing.T) {
+	// Flat areas of skin and of blue, with the same amount of detail (none).
+	img := image.NewRGBA(image.Rect(0, 0, 900, 300))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0x30, 0x40, 0xc0, 0xff}), image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 300, 300), image.NewUniform(color.RGBA{0xe0, 0xac, 0x90, 0xff}), image.ZP, draw.Src)
+
+	assert.Equal(t, image.Rect(0, 0, 300, 300), smartCropRect(img, 1, 1, true))
+	assert.Equal(t, image.Rect(300, 0, 600, 300), centerCropRect(img.Bounds(), 1, 1))
+}
+
+func TestFillImage(t *testing.T) {
+	img := noisyImage(300, 900, image.Rect(50, 20, 250, 220))
+	for _, strategy := range []string{"center", "smart"} {
+		filled := fillImage(img, 64, 48, strategy, false)
+		assert.Equal(t, image.Pt(64, 48), filled.Bounds().Size(), strategy)
+	}
+}
+
+func TestSanitizeAspect(t *testing.T) {
+	f, err := os.Open("test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	opts := &SanitizeOptions{
+		JPEGMode:     "fixed",
+		JPEGQuality:  80,
+		AspectWidth:  1,
+		AspectHeight: 1,
+		Crop:         "smart",
+	}
+	_, res, err := SanitizeImageFrom(f, opts)
+	if assert.NoError(t, err) {
+		assert.Equal(t, res.Width, res.Height)
+	}
+}
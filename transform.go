@@ -0,0 +1,238 @@
+package main
+
+// This file contains the on-the-fly transformations served from
+// /img/{id}/{transform}.  A transform is a comma-separated list of options:
+//
+//	300x200, 300x, x200 - the size to scale (or crop) the image to
+//	fit, fill, crop     - how to get to that size (default "fit"):
+//	                      fit scales the image down to fit within the size,
+//	                      fill scales and crops it to exactly the size, and
+//	                      crop cuts the size out of the middle without scaling
+//	jpeg, png, gif      - the format to serve the image in (default: the
+//	                      format it was stored in)
+//	q80                 - the JPEG quality to use
+//
+// So that nobody else can make us generate arbitrary sizes, each URL must be
+// signed with the secret from the config.
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// Transform describes how to derive an image from a stored one.
+type Transform struct {
+	Width   int
+	Height  int
+	Mode    string
+	Format  string
+	Quality int
+}
+
+var (
+	transformSizeRe    = regexp.MustCompile(`^(\d*)x(\d*)$`)
+	transformQualityRe = regexp.MustCompile(`^q(\d+)$`)
+)
+
+// Parses a transform string, checking it against the limits in the config.
+func parseTransform(s string, config *TransformConfig) (*Transform, error) {
+	t := &Transform{}
+	seen := map[string]bool{}
+
+	for _, opt := range strings.Split(s, ",") {
+		var kind string
+		switch {
+		case transformSizeRe.MatchString(opt):
+			kind = "size"
+			m := transformSizeRe.FindStringSubmatch(opt)
+			if len(m[1]) == 0 && len(m[2]) == 0 {
+				return nil, fmt.Errorf("invalid size '%s'", opt)
+			}
+			if len(m[1]) > 0 {
+				t.Width, _ = strconv.Atoi(m[1])
+			}
+			if len(m[2]) > 0 {
+				t.Height, _ = strconv.Atoi(m[2])
+			}
+		case opt == "fit" || opt == "fill" || opt == "crop":
+			kind = "mode"
+			t.Mode = opt
+		case opt == "jpeg" || opt == "png" || opt == "gif":
+			kind = "format"
+			t.Format = opt
+		case transformQualityRe.MatchString(opt):
+			kind = "quality"
+			t.Quality, _ = strconv.Atoi(opt[1:])
+			if t.Quality < 1 || t.Quality > 100 {
+				return nil, fmt.Errorf("quality must be from 1 to 100")
+			}
+		default:
+			return nil, fmt.Errorf("unknown transform option '%s'", opt)
+		}
+
+		if seen[kind] {
+			return nil, fmt.Errorf("%s given more than once", kind)
+		}
+		seen[kind] = true
+	}
+
+	if t.Width > config.MaxWidth || t.Height > config.MaxHeight {
+		return nil, fmt.Errorf("size cannot be larger than %dx%d",
+			config.MaxWidth, config.MaxHeight)
+	}
+
+	if len(t.Mode) == 0 {
+		t.Mode = "fit"
+	}
+	if (t.Mode == "fill" || t.Mode == "crop") && (t.Width == 0 || t.Height == 0) {
+		return nil, fmt.Errorf("'%s' needs both a width and a height", t.Mode)
+	}
+
+	return t, nil
+}
+
+// Applies the size and mode of a transform to an image.
+func (t *Transform) Apply(img image.Image) image.Image {
+	switch t.Mode {
+	case "fill":
+		return imaging.Thumbnail(img, t.Width, t.Height, imaging.Lanczos)
+	case "crop":
+		return imaging.CropCenter(img, t.Width, t.Height)
+	}
+
+	scaled, _ := fitImage(img, t.Width, t.Height)
+	return scaled
+}
+
+// Returns the signature for a transform of an image.
+func signTransform(secret, id, transform string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id + "/" + transform))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Checks the signature for a transform of an image, in constant time.
+func checkTransformSignature(secret, id, transform, sig string) bool {
+	expected := signTransform(secret, id, transform)
+	return hmac.Equal([]byte(expected), []byte(sig))
+}
+
+// cachedImage is a transformed image, ready to be served.
+type cachedImage struct {
+	ContentType string
+	Data        []byte
+}
+
+// derivativeCache stores transformed images, so that we don't need to fetch
+// and transform the original each time one is requested.  Keys are
+// "ID/TRANSFORM", so that every transform of an image can be purged when it
+// is deleted.  Purged IDs are remembered, and transforms of them are never
+// cached again, since one may have been in the middle of being made when the
+// image was deleted.
+type derivativeCache interface {
+	Get(key string) (*cachedImage, bool)
+	Put(key string, img *cachedImage)
+	Purge(id string)
+}
+
+// Returns the ID of the image that a cache key is for.
+func cacheKeyID(key string) string {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// memoryCache is a derivativeCache that keeps the most recently used images
+// in memory, up to a total size.
+type memoryCache struct {
+	mu    sync.Mutex
+	limit int64
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+
+	// The IDs that have been purged.
+	purged map[string]bool
+}
+
+type memoryCacheEntry struct {
+	key string
+	img *cachedImage
+}
+
+func newMemoryCache(limit int64) *memoryCache {
+	return &memoryCache{
+		limit:  limit,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+		purged: make(map[string]bool),
+	}
+}
+
+func (c *memoryCache) Get(key string) (*cachedImage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*memoryCacheEntry).img, true
+}
+
+func (c *memoryCache) Put(key string, img *cachedImage) {
+	size := int64(len(img.Data))
+	if size > c.limit {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.purged[cacheKeyID(key)] {
+		return
+	}
+	if e, ok := c.items[key]; ok {
+		c.size -= int64(len(e.Value.(*memoryCacheEntry).img.Data))
+		c.lru.Remove(e)
+	}
+
+	c.items[key] = c.lru.PushFront(&memoryCacheEntry{key, img})
+	c.size += size
+
+	for c.size > c.limit {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *memoryCache) Purge(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.purged[id] = true
+	for key, e := range c.items {
+		if cacheKeyID(key) == id {
+			c.remove(e)
+		}
+	}
+}
+
+// Must be called with the lock held.
+func (c *memoryCache) remove(e *list.Element) {
+	entry := e.Value.(*memoryCacheEntry)
+	c.lru.Remove(e)
+	delete(c.items, entry.key)
+	c.size -= int64(len(entry.img.Data))
+}
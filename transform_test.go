@@ -0,0 +1,123 @@
+package main
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTransform(t *testing.T) {
+	config := &TransformConfig{MaxWidth: 1000, MaxHeight: 800}
+
+	tr, err := parseTransform("300x200,fill,png,q70", config)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &Transform{300, 200, "fill", "png", 70}, tr)
+	}
+
+	tr, err = parseTransform("x100", config)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &Transform{0, 100, "fit", "", 0}, tr)
+	}
+
+	for _, bad := range []string{
+		"",
+		"x",
+		"300x200,300x200",
+		"300x200,fit,fill",
+		"2000x100",
+		"100x900",
+		"300x,fill",
+		"300x200,crop,webp",
+		"q0",
+		"q101",
+		"300X200",
+	} {
+		_, err := parseTransform(bad, config)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestTransformApply(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+
+	sizes := map[string]image.Point{
+		"100x100":       {100, 50},
+		"x50":           {100, 50},
+		"1000x1000":     {400, 200},
+		"100x100,fill":  {100, 100},
+		"100x100,crop":  {100, 100},
+		"1000x100,crop": {400, 100},
+	}
+	config := &TransformConfig{MaxWidth: 1000, MaxHeight: 1000}
+	for s, size := range sizes {
+		tr, err := parseTransform(s, config)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, size, tr.Apply(img).Bounds().Size(), s)
+	}
+}
+
+func TestTransformSignature(t *testing.T) {
+	sig := signTransform("secret", "AbCdEf1234", "300x200,fill")
+	assert.Len(t, sig, 32)
+	assert.True(t, checkTransformSignature("secret", "AbCdEf1234", "300x200,fill", sig))
+
+	assert.False(t, checkTransformSignature("other", "AbCdEf1234", "300x200,fill", sig))
+	assert.False(t, checkTransformSignature("secret", "AbCdEf1235", "300x200,fill", sig))
+	assert.False(t, checkTransformSignature("secret", "AbCdEf1234", "300x201,fill", sig))
+	assert.False(t, checkTransformSignature("secret", "AbCdEf1234", "300x200,fill", ""))
+}
+
+func TestMemoryCache(t *testing.T) {
+	c := newMemoryCache(10)
+	img := func(n int) *cachedImage {
+		return &cachedImage{ContentType: "image/png", Data: make([]byte, n)}
+	}
+
+	c.Put("a", img(4))
+	c.Put("b", img(4))
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+
+	// "b" is now the least recently used, so it goes first.
+	c.Put("c", img(4))
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	_, ok = c.Get("a")
+	assert.True(t, ok)
+	_, ok = c.Get("c")
+	assert.True(t, ok)
+
+	// Anything bigger than the whole cache isn't stored.
+	c.Put("d", img(11))
+	_, ok = c.Get("d")
+	assert.False(t, ok)
+	_, ok = c.Get("a")
+	assert.True(t, ok)
+}
+
+func TestMemoryCachePurge(t *testing.T) {
+	c := newMemoryCache(100)
+	img := &cachedImage{ContentType: "image/png", Data: []byte("data")}
+	for _, key := range []string{"a/100x100", "a/50x50", "ab/100x100"} {
+		c.Put(key, img)
+	}
+
+	c.Purge("a")
+	_, ok := c.Get("a/100x100")
+	assert.False(t, ok)
+	_, ok = c.Get("a/50x50")
+	assert.False(t, ok)
+	_, ok = c.Get("ab/100x100")
+	assert.True(t, ok)
+	assert.Equal(t, int64(4), c.size)
+
+	// Transforms that were being made when the image was deleted aren't
+	// cached.
+	c.Put("a/100x100", img)
+	_, ok = c.Get("a/100x100")
+	assert.False(t, ok)
+	assert.Equal(t, int64(4), c.size)
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 
 	// We depend on this as a dummy, so Godep will vendor the go-bindata source.
@@ -39,6 +40,18 @@ func getSize(s io.Seeker) (size int64, err error) {
 	return
 }
 
+// countingWriter counts the number of bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
 func ServeAsset(name, mime string) http.Handler {
 	// Assert that the asset exists.
 	_, err := Asset(name)
@@ -54,3 +67,12 @@ func ServeAsset(name, mime string) http.Handler {
 
 	return http.HandlerFunc(handler)
 }
+
+// Returns the IP address that a request came from.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
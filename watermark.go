@@ -0,0 +1,188 @@
+package main
+
+// This file contains the code that watermarks published images, with either
+// a line of text or a logo.  Watermarks are only ever drawn on the images we
+// publish - the archived original is the upload itself, and never has one.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// WatermarkOptions controls how images are watermarked.
+type WatermarkOptions struct {
+	// Exactly one of these is given: the text to draw, or the path to a PNG
+	// logo.
+	Text string `json:"text,omitempty"`
+	Logo string `json:"logo,omitempty"`
+
+	// The color of text watermarks.
+	Color color.NRGBA `json:"color"`
+
+	// Where the watermark goes: "top-left", "top", "top-right", "left",
+	// "center", "right", "bottom-left", "bottom" or "bottom-right".
+	Position string `json:"position"`
+
+	// How opaque the watermark is, from 0 to 1.
+	Opacity float64 `json:"opacity"`
+
+	// How large the watermark is, as a fraction of the image's size - it is
+	// scaled to fit in a box this fraction of the width and height.
+	Scale float64 `json:"scale"`
+
+	// How far the watermark is from the edges of the image, as a fraction of
+	// its smaller side.
+	Margin float64 `json:"margin"`
+
+	// Whether renditions are watermarked too.
+	Renditions bool `json:"renditions,omitempty"`
+}
+
+var watermarkPositions = map[string]bool{
+	"top-left": true, "top": true, "top-right": true,
+	"left": true, "center": true, "right": true,
+	"bottom-left": true, "bottom": true, "bottom-right": true,
+}
+
+var (
+	logosMu sync.Mutex
+	logos   = make(map[string]image.Image)
+)
+
+// Loads the logo at a path, keeping it in memory for next time.
+func loadLogo(path string) (image.Image, error) {
+	logosMu.Lock()
+	defer logosMu.Unlock()
+
+	if logo, ok := logos[path]; ok {
+		return logo, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	logo, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	logos[path] = logo
+	return logo, nil
+}
+
+// Draws text in the watermark font at its native size, in the given color,
+// with a dark shadow so that it can be read on light backgrounds too.
+func renderText(text string, c color.NRGBA) *image.NRGBA {
+	runes := []rune(text)
+	img := image.NewNRGBA(image.Rect(0, 0, len(runes)*fontWidth+1, fontHeight+1))
+
+	shadow := color.NRGBA{0, 0, 0, c.A / 2}
+	for _, layer := range []struct {
+		offset int
+		color  color.NRGBA
+	}{{1, shadow}, {0, c}} {
+		for i, r := range runes {
+			glyph := &fontGlyphs[len(fontGlyphs)-1]
+			if r >= fontFirst && r <= fontLast {
+				glyph = &fontGlyphs[r-fontFirst]
+			}
+
+			for y, row := range glyph {
+				for x := 0; x < fontWidth; x++ {
+					if row&(1<<uint(fontWidth-1-x)) != 0 {
+						img.SetNRGBA(i*fontWidth+x+layer.offset, y+layer.offset, layer.color)
+					}
+				}
+			}
+		}
+	}
+
+	return img
+}
+
+// Returns the watermark, at its native size.
+func watermarkImage(opts *WatermarkOptions) (image.Image, error) {
+	if len(opts.Logo) > 0 {
+		return loadLogo(opts.Logo)
+	}
+	return renderText(opts.Text, opts.Color), nil
+}
+
+// Scales the watermark for an image of the given size.  Text is scaled up by
+// a whole number of pixels first, so that it stays crisp.
+func scaleWatermark(mark image.Image, text bool, b image.Rectangle, scale float64) *image.NRGBA {
+	mb := mark.Bounds()
+	boxW, boxH := float64(b.Dx())*scale, float64(b.Dy())*scale
+	factor := math.Min(boxW/float64(mb.Dx()), boxH/float64(mb.Dy()))
+
+	w := int(float64(mb.Dx())*factor + 0.5)
+	h := int(float64(mb.Dy())*factor + 0.5)
+	if w < 1 || h < 1 {
+		return nil
+	}
+
+	if text && factor > 1 {
+		n := int(math.Ceil(factor))
+		mark = imaging.Resize(mark, mb.Dx()*n, mb.Dy()*n, imaging.NearestNeighbor)
+	}
+	return imaging.Resize(mark, w, h, imaging.Lanczos)
+}
+
+// Returns where a watermark of size w x h goes in b.
+func watermarkRect(b image.Rectangle, w, h int, position string, margin float64) image.Rectangle {
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	m := int(float64(side)*margin + 0.5)
+
+	x := b.Min.X + (b.Dx()-w)/2
+	switch position {
+	case "top-left", "left", "bottom-left":
+		x = b.Min.X + m
+	case "top-right", "right", "bottom-right":
+		x = b.Max.X - m - w
+	}
+
+	y := b.Min.Y + (b.Dy()-h)/2
+	switch position {
+	case "top-left", "top", "top-right":
+		y = b.Min.Y + m
+	case "bottom-left", "bottom", "bottom-right":
+		y = b.Max.Y - m - h
+	}
+
+	return image.Rect(x, y, x+w, y+h)
+}
+
+// Returns a copy of img with the watermark drawn on it.  If the image is too
+// small for the watermark to be visible, it is returned unchanged.
+func applyWatermark(img image.Image, opts *WatermarkOptions) (image.Image, error) {
+	mark, err := watermarkImage(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	scaled := scaleWatermark(mark, len(opts.Logo) == 0, b, opts.Scale)
+	if scaled == nil {
+		return img, nil
+	}
+
+	out := imaging.Clone(img)
+	r := watermarkRect(out.Bounds(), scaled.Bounds().Dx(), scaled.Bounds().Dy(), opts.Position, opts.Margin)
+	alpha := image.NewUniform(color.Alpha{uint8(opts.Opacity*0xff + 0.5)})
+	draw.DrawMask(out, r, scaled, image.ZP, alpha, image.ZP, draw.Over)
+	return out, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderText(t *testing.T) {
+	img := renderText("Hi", color.NRGBA{0xff, 0, 0, 0xff})
+	assert.Equal(t, image.Rect(0, 0, 2*fontWidth+1, fontHeight+1), img.Bounds())
+
+	// The left stroke of the 'H' is drawn in the color, with the shadow to
+	// its bottom right.
+	assert.Equal(t, color.NRGBA{0xff, 0, 0, 0xff}, img.NRGBAAt(0, 5))
+	assert.Equal(t, color.NRGBA{0, 0, 0, 0x7f}, img.NRGBAAt(1, 11))
+
+	// Characters outside the font are drawn as the replacement character.
+	unknown := renderText("é", color.NRGBA{0xff, 0xff, 0xff, 0xff})
+	replacement := renderText("�", color.NRGBA{0xff, 0xff, 0xff, 0xff})
+	assert.Equal(t, replacement.Pix, unknown.Pix)
+}
+
+func TestWatermarkRect(t *testing.T) {
+	b := image.Rect(0, 0, 1000, 500)
+	cases := map[string]image.Rectangle{
+		"top-left":     image.Rect(10, 10, 110, 30),
+		"top":          image.Rect(450, 10, 550, 30),
+		"right":        image.Rect(890, 240, 990, 260),
+		"center":       image.Rect(450, 240, 550, 260),
+		"bottom-right": image.Rect(890, 470, 990, 490),
+	}
+	for position, expected := range cases {
+		assert.Equal(t, expected, watermarkRect(b, 100, 20, position, 0.02), position)
+	}
+}
+
+func TestApplyWatermark(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0x40, 0x40, 0x40, 0xff}), image.ZP, draw.Src)
+
+	opts := &WatermarkOptions{
+		Text:     "imagehost",
+		Color:    color.NRGBA{0xff, 0xff, 0xff, 0xff},
+		Position: "bottom-right",
+		Opacity:  0.5,
+		Scale:    0.25,
+		Margin:   0.05,
+	}
+	out, err := applyWatermark(img, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, img.Bounds(), out.Bounds())
+
+	// The watermark is 100 pixels wide, 15 from the bottom right corner, and
+	// is drawn half-transparent.
+	var brightest uint8
+	changed := image.Rectangle{}
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			r, _, _, _ := out.At(x, y).RGBA()
+			v := uint8(r >> 8)
+			if v != 0x40 {
+				changed = changed.Union(image.Rect(x, y, x+1, y+1))
+			}
+			if v > brightest {
+				brightest = v
+			}
+		}
+	}
+	assert.Equal(t, 400-15, changed.Max.X)
+	assert.Equal(t, 300-15, changed.Max.Y)
+	assert.InDelta(t, 100, changed.Dx(), 1)
+	assert.InDelta(t, 0xa0, brightest, 4)
+
+	// The original isn't touched.
+	assert.Equal(t, color.RGBA{0x40, 0x40, 0x40, 0xff}, img.RGBAAt(399, 299))
+
+	// Images too small to fit the watermark are left alone.
+	tiny := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	out, err = applyWatermark(tiny, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, tiny, out)
+}
+
+func TestApplyLogoWatermark(t *testing.T) {
+	logo := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(logo, logo.Bounds(), image.NewUniform(color.NRGBA{0, 0xff, 0, 0xff}), image.ZP, draw.Src)
+
+	f, err := ioutil.TempFile("", "imagehost-logo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	assert.NoError(t, png.Encode(f, logo))
+	f.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	out, err := applyWatermark(img, &WatermarkOptions{
+		Logo:     f.Name(),
+		Position: "top-left",
+		Opacity:  1,
+		Scale:    0.5,
+	})
+	if assert.NoError(t, err) {
+		// The logo is scaled up to 100x50, in the top left corner.
+		assert.Equal(t, color.RGBA{0, 0xff, 0, 0xff}, color.RGBAModel.Convert(out.At(50, 25)))
+		assert.Equal(t, color.RGBA{0, 0xff, 0, 0xff}, color.RGBAModel.Convert(out.At(0, 0)))
+		assert.Equal(t, color.RGBA{0, 0, 0, 0}, color.RGBAModel.Convert(out.At(150, 25)))
+		assert.Equal(t, color.RGBA{0, 0, 0, 0}, color.RGBAModel.Convert(out.At(50, 100)))
+	}
+
+	_, err = applyWatermark(img, &WatermarkOptions{Logo: f.Name() + ".missing", Scale: 0.5})
+	assert.Error(t, err)
+}
+
+func TestSandboxLogoWatermarkRelativePath(t *testing.T) {
+	logo := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(logo, logo.Bounds(), image.NewUniform(color.NRGBA{0, 0xff, 0, 0xff}), image.ZP, draw.Src)
+
+	// A logo given relative to the working directory, which isn't the
+	// sandbox's.
+	name := "test-logo.png"
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	assert.NoError(t, png.Encode(f, logo))
+	f.Close()
+
+	watermark := &WatermarkConfig{Logo: name, Position: "top-left", Opacity: 1, Scale: 0.5}
+	if err := validateWatermark(watermark); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, filepath.IsAbs(watermark.Logo))
+
+	var in bytes.Buffer
+	png.Encode(&in, image.NewGray(image.Rect(0, 0, 200, 200)))
+
+	var out bytes.Buffer
+	opts := &SanitizeOptions{Format: "png", Watermark: watermark.options}
+	if _, err := sanitizeImage(&out, bytes.NewReader(in.Bytes()), opts, sandboxTestConfig()); !assert.NoError(t, err) {
+		return
+	}
+	img, err := png.Decode(&out)
+	if assert.NoError(t, err) {
+		assert.Equal(t, color.RGBA{0, 0xff, 0, 0xff}, color.RGBAModel.Convert(img.At(50, 25)))
+	}
+}
+
+func TestValidateWatermark(t *testing.T) {
+	config := &WatermarkConfig{Text: "example.com"}
+	if assert.NoError(t, validateWatermark(config)) {
+		assert.Equal(t, &WatermarkOptions{
+			Text:     "example.com",
+			Color:    color.NRGBA{0xff, 0xff, 0xff, 0xff},
+			Position: "bottom-right",
+			Opacity:  0.5,
+			Scale:    0.2,
+			Margin:   0.02,
+		}, config.options)
+	}
+
+	// Without a watermark, there's nothing to check.
+	config = &WatermarkConfig{}
+	assert.NoError(t, validateWatermark(config))
+	assert.Nil(t, config.options)
+
+	for _, bad := range []*WatermarkConfig{
+		{Enabled: true},
+		{Text: "a", Logo: "b.png"},
+		{Logo: "/does/not/exist.png"},
+		{Text: "a", Position: "middle"},
+		{Text: "a", Opacity: 2},
+		{Text: "a", Scale: -1},
+		{Text: "a", Color: "white"},
+	} {
+		assert.Error(t, validateWatermark(bad), "%+v", bad)
+	}
+}
+
+func TestWatermarkRenditions(t *testing.T) {
+	sanitize := func(watermark *WatermarkOptions) (*bytes.Buffer, *SanitizeResult) {
+		f, err := os.Open("test.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		var buf bytes.Buffer
+		res, err := SanitizeImageTo(&buf, f, &SanitizeOptions{
+			Format:     "png",
+			MaxWidth:   400,
+			Renditions: []RenditionSpec{{"small", 200, 200, "fit", ""}},
+			Watermark:  watermark,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &buf, res
+	}
+
+	watermark := &WatermarkOptions{
+		Text:     "imagehost",
+		Color:    color.NRGBA{0xff, 0, 0, 0xff},
+		Position: "center",
+		Opacity:  1,
+		Scale:    0.5,
+	}
+	plain, plainRes := sanitize(nil)
+	marked, markedRes := sanitize(watermark)
+
+	// Only the main image is watermarked by default...
+	assert.NotEqual(t, plain.Bytes(), marked.Bytes())
+	assert.Equal(t, plainRes.Renditions[0].Data, markedRes.Renditions[0].Data)
+
+	// ... but renditions can be too.
+	watermark.Renditions = true
+	_, markedRes = sanitize(watermark)
+	assert.NotEqual(t, plainRes.Renditions[0].Data, markedRes.Renditions[0].Data)
+}